@@ -0,0 +1,160 @@
+package logistic
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is a single file which may be packed into an archive
+type Entry struct {
+	// Name is the path of the file inside the archive, relative to the output directory, e.g. main/queue/id:000001
+	Name string
+	// Path is the absolute path of the file on disk
+	Path string
+	// Hash is the hex-encoded SHA-256 of the file contents. It is only set for testcases (queue entries, crashes and
+	// hangs), which never change once written by AFL. Entries without a hash (fuzz_bitmap, fuzzer_stats) are always transmitted.
+	Hash string
+}
+
+// hashCacheEntry remembers the hash of a file, as long as its size and modification time stay the same
+type hashCacheEntry struct {
+	size    int64
+	modTime time.Time
+	hash    string
+}
+
+var (
+	hashCache     = make(map[string]hashCacheEntry)
+	hashCacheLock sync.Mutex
+)
+
+// ScanFuzzer collects the entries of the given fuzzer we want to transmit: queue/, fuzz_bitmap, fuzzer_stats
+func ScanFuzzer(fuzzer string, fuzzerDirectory string) ([]Entry, error) {
+	// Essentially we want to pack three things from the targeted fuzzer:
+	// - the fuzz_bitmap file
+	// - the fuzzer_stats file
+	// - the queue/ directory - but avoiding duplicates
+
+	// We need full paths to read, but will write relative paths into the archive
+	relFuzzerPath := strings.TrimPrefix(fuzzer, fuzzerDirectory)
+
+	// Add the files which change constantly
+	entries := []Entry{
+		createEntry(fuzzerDirectory, relFuzzerPath, "fuzz_bitmap"),
+		createEntry(fuzzerDirectory, relFuzzerPath, "fuzzer_stats"),
+	}
+
+	// Add the queue entries
+	queueEntries, queueErr := scanTestcases(fuzzerDirectory, relFuzzerPath, "queue")
+	if queueErr != nil {
+		return nil, queueErr
+	}
+
+	return append(entries, queueEntries...), nil
+}
+
+// ScanFindings collects the crashes/ and hangs/ of the given fuzzer
+func ScanFindings(fuzzer string, fuzzerDirectory string) ([]Entry, error) {
+	relFuzzerPath := strings.TrimPrefix(fuzzer, fuzzerDirectory)
+
+	var entries []Entry
+	for _, dir := range []string{"crashes", "hangs"} {
+		// Skip directories AFL didn't create (yet)
+		_, statErr := os.Stat(fmt.Sprintf("%s%c%s%c%s", fuzzerDirectory, os.PathSeparator, relFuzzerPath, os.PathSeparator, dir))
+		if os.IsNotExist(statErr) {
+			continue
+		}
+
+		dirEntries, scanErr := scanTestcases(fuzzerDirectory, relFuzzerPath, dir)
+		if scanErr != nil {
+			return nil, scanErr
+		}
+		entries = append(entries, dirEntries...)
+	}
+
+	return entries, nil
+}
+
+// scanTestcases collects and hashes the files in the given directory of the fuzzer, e.g. queue/
+func scanTestcases(absPath string, relPath string, dir string) ([]Entry, error) {
+	// Get list of files
+	dirPath := fmt.Sprintf("%s%c%s%c%s", absPath, os.PathSeparator, relPath, os.PathSeparator, dir)
+	filesInDir, readErr := ioutil.ReadDir(dirPath)
+	if readErr != nil {
+		return nil, fmt.Errorf("failed to list directory content of %s: %s", dirPath, readErr)
+	}
+
+	// Walk over each file and add it to our entries
+	var entries []Entry
+	for _, f := range filesInDir {
+		// Check if we hit a directory (e.g. '.state')
+		if f.IsDir() {
+			// Ignore directories altogether
+			continue
+		}
+
+		// Calculate hash of the file
+		e := createEntry(absPath, relPath, fmt.Sprintf("%s%c%s", dir, os.PathSeparator, f.Name()))
+		hash, hashErr := hashFile(e.Path, f)
+		if hashErr != nil {
+			log.Printf("Failed to hash file %s: %s", e.Path, hashErr)
+			continue
+		}
+		e.Hash = hash
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// createEntry creates an entry without hash for the given file
+func createEntry(absPath string, relPath string, fileName string) Entry {
+	return Entry{
+		Name: fmt.Sprintf("%s%c%s", relPath, os.PathSeparator, fileName),
+		Path: fmt.Sprintf("%s%c%s%c%s", absPath, os.PathSeparator, relPath, os.PathSeparator, fileName),
+	}
+}
+
+// hashFile returns the hex-encoded SHA-256 of the file at the given path, avoiding to re-read unchanged files
+func hashFile(path string, info os.FileInfo) (string, error) {
+	// Check if we already know the hash of this file
+	hashCacheLock.Lock()
+	cached, ok := hashCache[path]
+	hashCacheLock.Unlock()
+	if ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.hash, nil
+	}
+
+	// Read and hash file
+	f, openErr := os.Open(path)
+	if openErr != nil {
+		return "", openErr
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, copyErr := io.Copy(h, f)
+	if copyErr != nil {
+		return "", copyErr
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	// Remember hash
+	hashCacheLock.Lock()
+	hashCache[path] = hashCacheEntry{
+		size:    info.Size(),
+		modTime: info.ModTime(),
+		hash:    hash,
+	}
+	hashCacheLock.Unlock()
+
+	return hash, nil
+}
@@ -0,0 +1,85 @@
+package logistic
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+)
+
+// HashIndex maps the SHA-256 of every queue entry in an output directory to the path of the entry.
+// It is used to avoid storing byte-identical testcases multiple times, even if they have different names in different
+// fuzzer directories.
+type HashIndex struct {
+	directory string
+	lock      sync.Mutex
+	hashes    map[string]string
+}
+
+// NewHashIndex creates an index for the given output directory. The index is filled on the first call to Refresh.
+func NewHashIndex(directory string) *HashIndex {
+	return &HashIndex{
+		directory: directory,
+		hashes:    make(map[string]string),
+	}
+}
+
+// Refresh adds all queue entries of all fuzzers in the output directory to the index. Unchanged files are not re-read.
+func (i *HashIndex) Refresh() {
+	// List fuzzers in output directory
+	fuzzers, readErr := ioutil.ReadDir(i.directory)
+	if readErr != nil {
+		log.Printf("Failed to list directory content of %s: %s", i.directory, readErr)
+		return
+	}
+
+	for _, fuzzer := range fuzzers {
+		// Skip everything which is not a directory
+		if !fuzzer.IsDir() {
+			continue
+		}
+
+		// List queue entries of this fuzzer
+		queuePath := fmt.Sprintf("%s%c%s%cqueue", i.directory, os.PathSeparator, fuzzer.Name(), os.PathSeparator)
+		filesInDir, queueErr := ioutil.ReadDir(queuePath)
+		if queueErr != nil {
+			// Not every directory is a fuzzer
+			continue
+		}
+
+		// Hash each queue entry
+		for _, f := range filesInDir {
+			if f.IsDir() {
+				continue
+			}
+
+			entryPath := fmt.Sprintf("%s%c%s", queuePath, os.PathSeparator, f.Name())
+			hash, hashErr := hashFile(entryPath, f)
+			if hashErr != nil {
+				log.Printf("Failed to hash file %s: %s", entryPath, hashErr)
+				continue
+			}
+			i.Add(hash, entryPath)
+		}
+	}
+}
+
+// Add adds the given hash to the index, if it is not yet known
+func (i *HashIndex) Add(hash string, path string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if _, ok := i.hashes[hash]; !ok {
+		i.hashes[hash] = path
+	}
+}
+
+// Lookup returns the path of the entry with the given hash, and whether such an entry is known at all
+func (i *HashIndex) Lookup(hash string) (string, bool) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	path, ok := i.hashes[hash]
+	return path, ok
+}
@@ -5,94 +5,99 @@ import (
 	"bytes"
 	"compress/flate"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
-	"strings"
 )
 
-// PackFuzzer packs the fuzzer into a TAR: queue/, fuzz_bitmap, fuzzer_stats
-func PackFuzzer(fuzzer string, fuzzerDirectory string) ([]byte, error) {
-	// Create TAR archive
-	var tarBuffer bytes.Buffer
-	tarWriter := tar.NewWriter(&tarBuffer)
-
-	// Essentially we want to pack three things from the targeted fuzzer:
-	// - the fuzz_bitmap file
-	// - the fuzzer_stats file
-	// - the queue/ directory - but avoiding duplicates
+// PackEntries packs the given entries into a TAR, compresses it with DEFLATE and writes the result to w.
+// Files are read and written one after another, so memory usage doesn't depend on the size of the archive.
+func PackEntries(w io.Writer, entries []Entry) error {
+	// Prepare FLATE compression
+	flateWrite, flateErr := flate.NewWriter(w, flate.BestCompression)
+	if flateErr != nil {
+		return fmt.Errorf("unable to prepare flate compressor: %s", flateErr)
+	}
 
-	// We need full paths to read, but will write relative paths into the TAR archive
-	absFuzzerPath := fuzzerDirectory
-	relFuzzerPath := strings.TrimPrefix(fuzzer, fuzzerDirectory)
+	// Create TAR archive
+	tarWriter := tar.NewWriter(flateWrite)
 
 	// Read-n-Pack™
-	packSingleFile(tarWriter, absFuzzerPath, relFuzzerPath, "fuzz_bitmap")
-	packSingleFile(tarWriter, absFuzzerPath, relFuzzerPath, "fuzzer_stats")
-	packQueueFiles(tarWriter, absFuzzerPath, relFuzzerPath)
+	for _, e := range entries {
+		packErr := packSingleFile(tarWriter, e)
+		if packErr != nil {
+			return packErr
+		}
+	}
 
 	// Close TAR archive
-	tarWriter.Close()
-
-	// Prepare FLATE compression
-	var flateBuffer bytes.Buffer
-	flateWrite, flateErr := flate.NewWriter(&flateBuffer, flate.BestCompression)
-	if flateErr != nil {
-		return nil, fmt.Errorf("unable to prepare flate compressor: %s", flateErr)
+	tarCloseErr := tarWriter.Close()
+	if tarCloseErr != nil {
+		return fmt.Errorf("unable to finish TAR archive: %s", tarCloseErr)
 	}
 
-	// Apply FLATE compression
-	flateWrite.Write(tarBuffer.Bytes())
-	flateWrite.Close()
+	// Flush FLATE compressor. Result: a DEFLATEd TAR archive
+	flateCloseErr := flateWrite.Close()
+	if flateCloseErr != nil {
+		return fmt.Errorf("unable to finish compressed stream: %s", flateCloseErr)
+	}
 
-	// Return result: a DEFLATEd TAR archive
-	return flateBuffer.Bytes(), nil
+	return nil
 }
 
 // packSingleFile packs a single file and writes it to the archive
-// fuzzerDirectory is the base directory, e.g. /project/fuzzers/
-// fuzzer is the name of the fuzzer itself, e.g. main-fuzzer-01
-// filename is the name of the file you want to pack, e.g. fuzzer_stats
-func packSingleFile(tarWriter *tar.Writer, absPath string, relPath string, fileName string) {
-	// Read file
-	readPath := fmt.Sprintf("%s%c%s%c%s", absPath, os.PathSeparator, relPath, os.PathSeparator, fileName)
-	contents, readErr := ioutil.ReadFile(readPath)
-	if readErr != nil {
-		log.Printf("Failed to read file %s: %s", readPath, readErr)
-		return
+// The file is read from the entry's absolute path, e.g. /project/fuzzers/main-fuzzer-01/fuzzer_stats,
+// and written into the archive using the entry's relative name, e.g. main-fuzzer-01/fuzzer_stats
+// Files which can't be read are skipped, but errors writing to the archive are returned.
+func packSingleFile(tarWriter *tar.Writer, e Entry) error {
+	// Queue entries never change once written, so we can stream them into the archive. Other files like fuzzer_stats
+	// are small, but may be rewritten by AFL at any time - read them at once to get a consistent size and content.
+	if e.Hash == "" {
+		contents, readErr := ioutil.ReadFile(e.Path)
+		if readErr != nil {
+			log.Printf("Failed to read file %s: %s", e.Path, readErr)
+			return nil
+		}
+		return packReader(tarWriter, e, bytes.NewReader(contents), int64(len(contents)))
 	}
 
+	// Open file
+	f, openErr := os.Open(e.Path)
+	if openErr != nil {
+		log.Printf("Failed to read file %s: %s", e.Path, openErr)
+		return nil
+	}
+	defer f.Close()
+
+	// Get file size
+	info, statErr := f.Stat()
+	if statErr != nil {
+		log.Printf("Failed to read file %s: %s", e.Path, statErr)
+		return nil
+	}
+
+	return packReader(tarWriter, e, f, info.Size())
+}
+
+// packReader writes size bytes read from r into the archive, using the name of the given entry
+func packReader(tarWriter *tar.Writer, e Entry, r io.Reader, size int64) error {
 	// Create header for this file
 	header := &tar.Header{
-		Name: fmt.Sprintf("%s%c%s", relPath, os.PathSeparator, fileName),
+		Name: e.Name,
 		Mode: 0600,
-		Size: int64(len(contents)),
+		Size: size,
 	}
 
 	// Add header and contents to archive
-	tarWriter.WriteHeader(header)
-	tarWriter.Write(contents)
-}
-
-// Packs the files in the given directory into a tar archive
-func packQueueFiles(tarWriter *tar.Writer, absPath string, relPath string) {
-	// Get list of queue files
-	queuePath := fmt.Sprintf("%s%c%s%cqueue", absPath, os.PathSeparator, relPath, os.PathSeparator)
-	filesInDir, readErr := ioutil.ReadDir(queuePath)
-	if readErr != nil {
-		log.Printf("Failed to list directory content of %s: %s", queuePath, readErr)
-		return
+	headerErr := tarWriter.WriteHeader(header)
+	if headerErr != nil {
+		return fmt.Errorf("unable to write TAR header for %s: %s", e.Name, headerErr)
 	}
-
-	// Walk over each file and add it to our archive
-	for _, f := range filesInDir {
-		// Check if we hit a directory (e.g. '.state')
-		if f.IsDir() {
-			// Ignore directories altogether
-			continue
-		}
-
-		// Pack into the archive
-		packSingleFile(tarWriter, absPath, relPath, fmt.Sprintf("queue%c%s", os.PathSeparator, f.Name()))
+	_, copyErr := io.CopyN(tarWriter, r, size)
+	if copyErr != nil {
+		return fmt.Errorf("unable to pack file %s: %s", e.Path, copyErr)
 	}
+
+	return nil
 }
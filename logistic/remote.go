@@ -0,0 +1,77 @@
+package logistic
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+// remoteMarker is the name of the file placed in fuzzer directories received from peers
+const remoteMarker = ".afl-transmit-remote"
+
+// IsRemoteFuzzer checks if the given fuzzer directory was received from a peer, rather than being a local fuzzer
+func IsRemoteFuzzer(fuzzerPath string) bool {
+	_, statErr := os.Stat(fmt.Sprintf("%s%c%s", fuzzerPath, os.PathSeparator, remoteMarker))
+	return statErr == nil
+}
+
+// RemoteOrigin returns the peer the given fuzzer directory was received from, or an empty string if it is a local
+// fuzzer or the peer is unknown
+func RemoteOrigin(fuzzerPath string) string {
+	origin, readErr := ioutil.ReadFile(fmt.Sprintf("%s%c%s", fuzzerPath, os.PathSeparator, remoteMarker))
+	if readErr != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(origin))
+}
+
+// RemoteFuzzerName returns the name under which the given fuzzer of the given peer is stored, e.g. 10.0.0.2_main for
+// the fuzzer main of the peer 10.0.0.2. Characters of the peer which are unusual in directory names are replaced.
+func RemoteFuzzerName(origin string, fuzzer string) string {
+	sanitized := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '-'
+	}, origin)
+	return sanitized + "_" + fuzzer
+}
+
+// markRemoteFuzzer marks the given fuzzer directory as received from the given peer, and returns whether files of
+// that fuzzer may be stored. Directories of local fuzzers are never marked, as we would stop transmitting them, and
+// directories received from other peers are left alone.
+func markRemoteFuzzer(fuzzerPath string, origin string) bool {
+	// Check if some funny stuff is going on
+	if strings.Contains(fuzzerPath, "..") {
+		return false
+	}
+
+	// Check if the directory is marked already
+	if IsRemoteFuzzer(fuzzerPath) {
+		if other := RemoteOrigin(fuzzerPath); other != origin {
+			log.Printf("Refusing fuzzer %s of %s, it was received from %s", fuzzerPath, origin, other)
+			return false
+		}
+		return true
+	} else if _, statErr := os.Stat(fuzzerPath); statErr == nil {
+		// The directory belongs to a local fuzzer with the same name
+		log.Printf("Refusing fuzzer %s of %s, a local fuzzer has the same name", fuzzerPath, origin)
+		return false
+	}
+
+	// Create directory if required, and place the marker in it
+	mkdirErr := os.MkdirAll(fuzzerPath, 0755)
+	if mkdirErr != nil {
+		log.Printf("Failed to create directory %s: %s", fuzzerPath, mkdirErr)
+		return false
+	}
+	writeErr := ioutil.WriteFile(fmt.Sprintf("%s%c%s", fuzzerPath, os.PathSeparator, remoteMarker), []byte(origin+"\n"), 0644)
+	if writeErr != nil {
+		log.Printf("Failed to mark %s as received from a peer: %s", fuzzerPath, writeErr)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,129 @@
+package logistic
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// packTestArchive packs files with the given names, each containing the given content, into an archive
+func packTestArchive(t *testing.T, names []string, content string) *bytes.Buffer {
+	srcDir, _ := ioutil.TempDir("", "afl-transmit-src")
+	defer os.RemoveAll(srcDir)
+
+	var entries []Entry
+	for _, name := range names {
+		path := filepath.Join(srcDir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, []byte(content), 0644)
+		entries = append(entries, Entry{Name: name, Path: path})
+	}
+
+	var archive bytes.Buffer
+	packErr := PackEntries(&archive, entries)
+	if packErr != nil {
+		t.Fatalf("PackEntries() failed: %s", packErr)
+	}
+	return &archive
+}
+
+func TestUnpackIntoKeepsLocalFuzzers(t *testing.T) {
+	archive := packTestArchive(t, []string{"main/queue/id:000001", "other/queue/id:000001"}, "remote")
+
+	// Prepare a local fuzzer named "main"
+	targetDir, _ := ioutil.TempDir("", "afl-transmit-target")
+	defer os.RemoveAll(targetDir)
+	localMain := filepath.Join(targetDir, "main")
+	os.MkdirAll(filepath.Join(localMain, "queue"), 0755)
+	ioutil.WriteFile(filepath.Join(localMain, "is_main_node"), nil, 0644)
+
+	unpackErr := UnpackInto(archive, targetDir, nil, "10.0.0.2")
+	if unpackErr != nil {
+		t.Fatalf("UnpackInto() failed: %s", unpackErr)
+	}
+
+	// The local fuzzer must stay local, and must not receive the files of the remote one
+	if IsRemoteFuzzer(localMain) {
+		t.Errorf("local fuzzer %s was marked as remote", localMain)
+	}
+	if _, statErr := os.Stat(filepath.Join(localMain, "queue", "id:000001")); statErr == nil {
+		t.Errorf("files of the remote fuzzer were stored in the local fuzzer %s", localMain)
+	}
+
+	// Remote fuzzers are stored under their own names and marked as usual
+	for _, name := range []string{"10.0.0.2_main", "10.0.0.2_other"} {
+		remote := filepath.Join(targetDir, name)
+		if !IsRemoteFuzzer(remote) || RemoteOrigin(remote) != "10.0.0.2" {
+			t.Errorf("remote fuzzer %s was not marked as received from 10.0.0.2", remote)
+		}
+		if _, statErr := os.Stat(filepath.Join(remote, "queue", "id:000001")); statErr != nil {
+			t.Errorf("files of the remote fuzzer %s were not stored: %s", remote, statErr)
+		}
+	}
+}
+
+func TestUnpackIntoSeparatesPeers(t *testing.T) {
+	targetDir, _ := ioutil.TempDir("", "afl-transmit-target")
+	defer os.RemoveAll(targetDir)
+
+	// Two peers send a fuzzer with the same name
+	origins := []string{"10.0.0.2", "fuzzer.example.com"}
+	for _, origin := range origins {
+		archive := packTestArchive(t, []string{"s1/queue/id:000001"}, origin)
+		unpackErr := UnpackInto(archive, targetDir, nil, origin)
+		if unpackErr != nil {
+			t.Fatalf("UnpackInto() of %s failed: %s", origin, unpackErr)
+		}
+	}
+
+	// Both must be kept
+	for _, origin := range origins {
+		remote := filepath.Join(targetDir, RemoteFuzzerName(origin, "s1"))
+		if RemoteOrigin(remote) != origin {
+			t.Errorf("fuzzer %s was marked as received from %q, want %s", remote, RemoteOrigin(remote), origin)
+		}
+		content, _ := ioutil.ReadFile(filepath.Join(remote, "queue", "id:000001"))
+		if string(content) != origin {
+			t.Errorf("testcase of %s contains %q, want %q", remote, content, origin)
+		}
+	}
+}
+
+func TestMarkRemoteFuzzerRefusesOtherOrigin(t *testing.T) {
+	targetDir, _ := ioutil.TempDir("", "afl-transmit-target")
+	defer os.RemoveAll(targetDir)
+	fuzzerPath := filepath.Join(targetDir, "s1")
+
+	if !markRemoteFuzzer(fuzzerPath, "10.0.0.2") {
+		t.Fatalf("markRemoteFuzzer() refused new fuzzer")
+	}
+	if !markRemoteFuzzer(fuzzerPath, "10.0.0.2") {
+		t.Errorf("markRemoteFuzzer() refused fuzzer of the same origin")
+	}
+	if markRemoteFuzzer(fuzzerPath, "10.0.0.3") {
+		t.Errorf("markRemoteFuzzer() accepted fuzzer received from another origin")
+	}
+	if RemoteOrigin(fuzzerPath) != "10.0.0.2" {
+		t.Errorf("origin of %s changed to %s", fuzzerPath, RemoteOrigin(fuzzerPath))
+	}
+}
+
+func TestRemoteFuzzerName(t *testing.T) {
+	tests := []struct {
+		origin string
+		want   string
+	}{
+		{"10.0.0.2", "10.0.0.2_main"},
+		{"fuzzer.example.com", "fuzzer.example.com_main"},
+		{"2001:db8::1", "2001-db8--1_main"},
+		{"fe80::1%eth0", "fe80--1-eth0_main"},
+	}
+
+	for _, test := range tests {
+		if got := RemoteFuzzerName(test.origin, "main"); got != test.want {
+			t.Errorf("RemoteFuzzerName(%q, \"main\") = %q, want %q", test.origin, got, test.want)
+		}
+	}
+}
@@ -2,8 +2,9 @@ package logistic
 
 import (
 	"archive/tar"
-	"bytes"
 	"compress/flate"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -13,20 +14,19 @@ import (
 	"strings"
 )
 
-// UnpackInto decrompesses the given bytes with DEFLATE, then unpacks the result as TAR archive into the targetDir
-func UnpackInto(raw []byte, targetDir string) error {
+// UnpackInto decompresses the given stream with DEFLATE, then unpacks the result as TAR archive into the targetDir.
+// The archive is processed while it is read, so memory usage doesn't depend on the size of the archive.
+// Queue entries which are byte-identical to an entry in the given index are skipped, and stored entries are added to
+// it. Keeping the index up to date with the local fuzzers is up to the caller, see HashIndex.Refresh. If index is nil,
+// no entries are skipped. Each fuzzer directory in the archive is stored under a name prefixed with origin, see
+// RemoteFuzzerName, and marked as received from origin.
+func UnpackInto(r io.Reader, targetDir string, index *HashIndex, origin string) error {
 	// Prepare FLATE decompressor
-	var flateBuffer bytes.Buffer
-	flateReader := flate.NewReader(&flateBuffer)
-
-	// Uncompress
-	flateBuffer.Write(raw)
-	raw, _ = ioutil.ReadAll(flateReader)
+	flateReader := flate.NewReader(r)
+	defer flateReader.Close()
 
 	// Open TAR archive
-	var tarBuffer bytes.Buffer
-	tarBuffer.Write(raw)
-	tarReader := tar.NewReader(&tarBuffer)
+	tarReader := tar.NewReader(flateReader)
 
 	// Create queue directory if it doesn't exist yet
 	_, folderErr := os.Stat(targetDir)
@@ -34,6 +34,9 @@ func UnpackInto(raw []byte, targetDir string) error {
 		os.Mkdir(targetDir, 0755)
 	}
 
+	// Fuzzer directories we already checked, and whether we store their files
+	accepted := make(map[string]bool)
+
 	// Iterate over all files in the archive
 	for {
 		// Read header
@@ -43,51 +46,126 @@ func UnpackInto(raw []byte, targetDir string) error {
 			break
 		} else if headerErr != nil {
 			// Unknown error occurred
-			log.Printf("Error parsing TAR header entry: %s", headerErr)
-			break
+			return fmt.Errorf("error parsing TAR header entry: %s", headerErr)
+		}
+
+		// Keep the fuzzers of different peers apart, even if they have the same name
+		parts := strings.SplitN(strings.TrimLeft(header.Name, "/"), "/", 2)
+		if len(parts) < 2 {
+			// Not part of a fuzzer directory
+			continue
+		}
+		fuzzer := RemoteFuzzerName(origin, parts[0])
+
+		// Mark the fuzzer directory as received from a peer - unless it belongs to a local fuzzer or another peer
+		ok, checked := accepted[fuzzer]
+		if !checked {
+			ok = markRemoteFuzzer(fmt.Sprintf("%s%c%s", targetDir, os.PathSeparator, fuzzer), origin)
+			accepted[fuzzer] = ok
+		}
+		if !ok {
+			continue
 		}
 
 		// Write file
-		var fileBuffer bytes.Buffer
-		io.Copy(&fileBuffer, tarReader)
-		unpackSingleFile(fileBuffer.Bytes(), targetDir, header.Name)
+		unpackSingleFile(tarReader, targetDir, fuzzer+"/"+parts[1], index)
 	}
 
 	return nil
 }
 
-// Writes the contents to the target
-func unpackSingleFile(raw []byte, targetDirectory string, filename string) {
+// isQueueEntry checks if the given archive path belongs to a queue/ directory
+func isQueueEntry(name string) bool {
+	return path.Base(path.Dir(name)) == "queue"
+}
+
+// isTestcase checks if the given archive path belongs to a queue/, crashes/ or hangs/ directory
+func isTestcase(name string) bool {
+	dir := path.Base(path.Dir(name))
+	return dir == "queue" || dir == "crashes" || dir == "hangs"
+}
+
+// Writes the contents to the target, returning whether the file was written.
+// Testcases are never overwritten. Queue entries are skipped if we already have a byte-identical entry anywhere in the
+// index.
+func unpackSingleFile(r io.Reader, targetDirectory string, filename string, index *HashIndex) bool {
 	destPath := fmt.Sprintf("%s%c%s", targetDirectory, os.PathSeparator, filename)
+	isQueue := isQueueEntry(filename) && index != nil
 
-	// Check if the file already exists - we won't overwrite it then
+	// Check if the testcase already exists - we won't overwrite it then
 	_, fileInfoErr := os.Stat(destPath)
-	if os.IsExist(fileInfoErr) {
+	if isTestcase(filename) && fileInfoErr == nil {
 		// File already exists, we don't need to write a thing
-		return
+		return false
 	}
 
 	// Check if some funny stuff is going on
 	if strings.Contains(targetDirectory, "..") || strings.Contains(filename, "..") {
 		log.Printf("Skipping traversal filename: %s", filename)
-		return
+		return false
 	}
 
 	// Check if the target directory already exists - otherwise we create it
-	dirOfFile := path.Dir(fmt.Sprintf("%s%c%s", targetDirectory, os.PathSeparator, filename))
+	dirOfFile := path.Dir(destPath)
 	_, dirInfoErr := os.Stat(dirOfFile)
 	if os.IsNotExist(dirInfoErr) {
 		// Create directories as required
 		mkdirErr := os.MkdirAll(dirOfFile, 0755)
 		if mkdirErr != nil {
 			log.Printf("Failed to create directory %s: %s", dirOfFile, mkdirErr)
-			return
+			return false
 		}
 	}
 
-	// Write file
-	writeErr := ioutil.WriteFile(destPath, raw, 0644)
-	if writeErr != nil {
-		log.Printf("Unable to write to file %s: %s", destPath, writeErr)
+	// Write into a temporary file first, so AFL never picks up a partially written file. The leading dot makes sure
+	// AFL ignores the file while it is being written.
+	tmpFile, tmpErr := ioutil.TempFile(dirOfFile, ".afl-transmit-")
+	if tmpErr != nil {
+		log.Printf("Unable to create temporary file in %s: %s", dirOfFile, tmpErr)
+		return false
+	}
+	defer os.Remove(tmpFile.Name())
+
+	// Write file, hashing it on the way
+	h := sha256.New()
+	_, copyErr := io.Copy(io.MultiWriter(tmpFile, h), r)
+	closeErr := tmpFile.Close()
+	if copyErr != nil || closeErr != nil {
+		log.Printf("Unable to write to file %s: %s", destPath, firstErr(copyErr, closeErr))
+		return false
 	}
+
+	// Check if we already have this queue entry, maybe under a different name or in a different fuzzer directory
+	hash := hex.EncodeToString(h.Sum(nil))
+	if isQueue {
+		if _, known := index.Lookup(hash); known {
+			// Duplicate, no need to keep it
+			return false
+		}
+	}
+
+	// Move file into place
+	os.Chmod(tmpFile.Name(), 0644)
+	renameErr := os.Rename(tmpFile.Name(), destPath)
+	if renameErr != nil {
+		log.Printf("Unable to write to file %s: %s", destPath, renameErr)
+		return false
+	}
+
+	// Remember the new queue entry
+	if isQueue {
+		index.Add(hash, destPath)
+	}
+
+	return true
+}
+
+// firstErr returns the first of the given errors which is not nil
+func firstErr(errs ...error) error {
+	for _, e := range errs {
+		if e != nil {
+			return e
+		}
+	}
+	return nil
 }
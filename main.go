@@ -7,6 +7,9 @@ import (
 	"github.com/maride/afl-transmit/stats"
 	"github.com/maride/afl-transmit/watchdog"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 var (
@@ -14,15 +17,48 @@ var (
 )
 
 func main() {
+	// Check for subcommands, which need to be removed before parsing flags
+	subcommand := ""
+	if len(os.Args) > 1 && (os.Args[1] == "status" || os.Args[1] == "keygen" || os.Args[1] == "members") {
+		subcommand = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
 	// Register flags
 	watchdog.RegisterWatchdogFlags()
 	net.RegisterSenderFlags()
 	net.RegisterListenFlags()
+	net.RegisterAccessFlags()
 	net.RegisterCryptFlags()
+	net.RegisterTLSFlags()
+	net.RegisterIdentityFlags()
+	net.RegisterDiscoveryFlags()
+	net.RegisterGossipFlags()
 	stats.RegisterStatsFlags()
+	stats.RegisterMetricsFlags()
 	RegisterGlobalFlags()
 	flag.Parse()
 
+	// Run subcommand and quit, if desired
+	switch subcommand {
+	case "status":
+		// Print status of the mesh
+		if outputDirectory == "" {
+			fmt.Println("Please specify the output directory of the fuzzer(s) using --fuzzer-directory")
+			return
+		}
+		stats.PrintMeshStatus(os.Stdout, outputDirectory)
+		return
+	case "keygen":
+		// Write a new key file
+		keygenErr := net.GenerateKeyFile()
+		if keygenErr != nil {
+			fmt.Printf("Failed to generate key: %s\n", keygenErr)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Read peers file
 	net.ReadPeers()
 
@@ -33,12 +69,60 @@ func main() {
 		return
 	}
 
+	// Load identity if desired
+	identityErr := net.InitIdentity()
+	if identityErr != nil {
+		fmt.Printf("Failed to load identity: %s", identityErr)
+		return
+	}
+
+	// Initialize TLS transport if desired
+	tlsErr := net.InitTLS()
+	if tlsErr != nil {
+		fmt.Printf("Failed to initialize TLS: %s", tlsErr)
+		return
+	}
+
+	// Print members of the mesh and quit, if desired - this talks to the local node, using the same keys as a peer
+	if subcommand == "members" {
+		membersErr := net.PrintMembers(os.Stdout)
+		if membersErr != nil {
+			fmt.Printf("Failed to get members from the local node: %s\n", membersErr)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Check if gossip can be used
+	gossipErr := net.InitGossip()
+	if gossipErr != nil {
+		fmt.Printf("Failed to initialize gossip: %s", gossipErr)
+		return
+	}
+
+	// Keep track of the IPs of our peers, and of changes to the peer file
+	go net.WatchPeerAddresses()
+	go net.WatchPeerFile()
+
+	// Find peers in the local network if desired
+	go net.Discover()
+
+	// Exchange members of the mesh with peers if desired
+	go net.Gossip()
+
+	// Reload keys if asked to
+	go reloadOnSignal()
+
 	// Start watchdog for local afl instances
 	go watchdog.WatchFuzzers(outputDirectory)
 
-	// Start stat printer
+	// Start stat printer, and keep track of the fuzzer stats of the whole mesh
+	go stats.WatchFuzzerStats(outputDirectory)
 	go stats.PrintStats()
 
+	// Serve metrics if desired
+	go stats.ServeMetrics()
+
 	// Listen for incoming connections
 	listenErr := net.Listen(outputDirectory)
 	if listenErr != nil {
@@ -46,6 +130,22 @@ func main() {
 	}
 }
 
+// Reloads the keys and peers whenever we receive SIGHUP, which allows to rotate keys and change peers without
+// restarting
+func reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		log.Println("Received SIGHUP, reloading keys and peers")
+		reloadErr := net.ReloadCrypt()
+		if reloadErr != nil {
+			log.Printf("Failed to reload keys: %s", reloadErr)
+		}
+		net.ReloadPeers()
+	}
+}
+
 // Registers flags which are required by multiple modules and need to be handled here
 func RegisterGlobalFlags() {
 	flag.StringVar(&outputDirectory, "fuzzer-directory", "", "The output directory of the fuzzer(s)")
@@ -0,0 +1,125 @@
+package net
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var (
+	allowString string
+	denyString  string
+)
+
+// RegisterAccessFlags registers the flags required for access control
+func RegisterAccessFlags() {
+	flag.StringVar(&allowString, "allow", "", "Only allow connections from these networks, comma-separated, e.g. 10.0.0.0/8,fd00::/8. Combined with --restrict-to-peers, connections from peers are allowed as well")
+	flag.StringVar(&denyString, "deny", "", "Refuse connections from these networks, comma-separated. Takes precedence over --allow and --restrict-to-peers")
+}
+
+// accessControl decides which hosts may connect to the listener
+type accessControl struct {
+	allow           []*net.IPNet
+	deny            []*net.IPNet
+	restrictToPeers bool
+	peerIPs         func() []net.IP
+}
+
+// newAccessControl creates the access control configured by the user
+func newAccessControl() (*accessControl, error) {
+	allow, allowErr := parseNetworks(allowString)
+	if allowErr != nil {
+		return nil, fmt.Errorf("invalid --allow: %s", allowErr)
+	}
+	deny, denyErr := parseNetworks(denyString)
+	if denyErr != nil {
+		return nil, fmt.Errorf("invalid --deny: %s", denyErr)
+	}
+
+	return &accessControl{
+		allow:           allow,
+		deny:            deny,
+		restrictToPeers: restrictToPeers,
+		peerIPs:         peerIPs,
+	}, nil
+}
+
+// permits checks if the host with the given IP may connect, returning the reason if it may not
+func (a *accessControl) permits(ip net.IP) (bool, string) {
+	// Denied networks take precedence
+	for _, n := range a.deny {
+		if n.Contains(ip) {
+			return false, fmt.Sprintf("%s is in denied network %s", ip, n)
+		}
+	}
+
+	// If neither allowed networks nor peer restriction are given, everyone else may connect
+	if len(a.allow) == 0 && !a.restrictToPeers {
+		return true, ""
+	}
+
+	// Check allowed networks
+	for _, n := range a.allow {
+		if n.Contains(ip) {
+			return true, ""
+		}
+	}
+
+	// Check peers
+	if a.restrictToPeers {
+		for _, peerIP := range a.peerIPs() {
+			if peerIP.Equal(ip) {
+				return true, ""
+			}
+		}
+	}
+
+	return false, fmt.Sprintf("%s is neither a peer nor in an allowed network", ip)
+}
+
+// permitsAddress checks if the host with the given address may connect, see permits
+func (a *accessControl) permitsAddress(addr net.Addr) (bool, string) {
+	// Get IP of the remote host
+	host, _, splitErr := net.SplitHostPort(addr.String())
+	if splitErr != nil {
+		return false, fmt.Sprintf("unable to parse address %s: %s", addr, splitErr)
+	}
+	ip := net.ParseIP(stripZone(host))
+	if ip == nil {
+		return false, fmt.Sprintf("unable to parse address %s", addr)
+	}
+
+	return a.permits(ip)
+}
+
+// parseNetworks parses the given comma-separated list of networks. Single IPs are treated as networks of one host.
+func parseNetworks(raw string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		// Check if it is a single IP
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		// Parse network
+		_, n, parseErr := net.ParseCIDR(entry)
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		networks = append(networks, n)
+	}
+
+	return networks, nil
+}
@@ -0,0 +1,112 @@
+package net
+
+import (
+	"github.com/maride/afl-transmit/stats"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestAccessControl creates an access control from the given flag values, treating peerIPs as the IPs of the peers
+func newTestAccessControl(t *testing.T, allow string, deny string, restrict bool, peerIPs ...string) *accessControl {
+	allowNetworks, allowErr := parseNetworks(allow)
+	if allowErr != nil {
+		t.Fatalf("parseNetworks(%q) failed: %s", allow, allowErr)
+	}
+	denyNetworks, denyErr := parseNetworks(deny)
+	if denyErr != nil {
+		t.Fatalf("parseNetworks(%q) failed: %s", deny, denyErr)
+	}
+
+	var ips []net.IP
+	for _, ip := range peerIPs {
+		ips = append(ips, net.ParseIP(ip))
+	}
+
+	return &accessControl{
+		allow:           allowNetworks,
+		deny:            denyNetworks,
+		restrictToPeers: restrict,
+		peerIPs:         func() []net.IP { return ips },
+	}
+}
+
+func TestAccessControlPermits(t *testing.T) {
+	tests := []struct {
+		name     string
+		allow    string
+		deny     string
+		restrict bool
+		peerIPs  []string
+		ip       string
+		want     bool
+	}{
+		{"no restrictions", "", "", false, nil, "192.0.2.1", true},
+		{"allowed network", "10.0.0.0/8", "", false, nil, "10.1.2.3", true},
+		{"outside allowed network", "10.0.0.0/8", "", false, nil, "192.0.2.1", false},
+		{"allowed single IP", "192.0.2.1", "", false, nil, "192.0.2.1", true},
+		{"other than allowed single IP", "192.0.2.1", "", false, nil, "192.0.2.2", false},
+		{"allowed IPv6 network", "fd00::/8", "", false, nil, "fd00::1", true},
+		{"allowed single IPv6", "2001:db8::1", "", false, nil, "2001:db8::1", true},
+		{"denied network", "", "10.0.0.0/8", false, nil, "10.1.2.3", false},
+		{"outside denied network", "", "10.0.0.0/8", false, nil, "192.0.2.1", true},
+		{"deny takes precedence over allow", "10.0.0.0/8", "10.1.0.0/16", false, nil, "10.1.2.3", false},
+		{"deny takes precedence over peers", "", "10.1.0.0/16", true, []string{"10.1.2.3"}, "10.1.2.3", false},
+		{"peer", "", "", true, []string{"10.1.2.3"}, "10.1.2.3", true},
+		{"not a peer", "", "", true, []string{"10.1.2.3"}, "10.1.2.4", false},
+		{"allowed network or peer", "192.0.2.0/24", "", true, []string{"10.1.2.3"}, "192.0.2.1", true},
+		{"IPv4-mapped IPv6 in allowed network", "10.0.0.0/8", "", false, nil, "::ffff:10.1.2.3", true},
+		{"IPv4-mapped IPv6 in denied network", "", "10.0.0.0/8", false, nil, "::ffff:10.1.2.3", false},
+		{"IPv4-mapped IPv6 of allowed single IP", "192.0.2.1", "", false, nil, "::ffff:192.0.2.1", true},
+		{"IPv4-mapped IPv6 of peer", "", "", true, []string{"10.1.2.3"}, "::ffff:10.1.2.3", true},
+	}
+
+	for _, test := range tests {
+		a := newTestAccessControl(t, test.allow, test.deny, test.restrict, test.peerIPs...)
+		got, reason := a.permits(net.ParseIP(test.ip))
+		if got != test.want {
+			t.Errorf("%s: permits(%s) = %v (%s), want %v", test.name, test.ip, got, reason, test.want)
+		}
+	}
+}
+
+func TestParseNetworksRefusesGarbage(t *testing.T) {
+	for _, raw := range []string{"10.0.0.0/33", "not-a-network", "10.0.0.0/8,nope"} {
+		if _, parseErr := parseNetworks(raw); parseErr == nil {
+			t.Errorf("parseNetworks(%q) succeeded, want error", raw)
+		}
+	}
+}
+
+func TestServeRejectsConnection(t *testing.T) {
+	outputDirectory, _ := ioutil.TempDir("", "afl-transmit-serve")
+	defer os.RemoveAll(outputDirectory)
+
+	// Listen on loopback, but only allow another network
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatalf("Listen() failed: %s", listenErr)
+	}
+	access := newTestAccessControl(t, "192.0.2.0/24", "", false)
+	go serve([]net.Listener{listener}, outputDirectory, access)
+
+	// Connect - the listener must close the connection right away
+	rejectedBefore := stats.TakeSnapshot().RejectedConnections
+	conn, dialErr := net.Dial("tcp", listener.Addr().String())
+	if dialErr != nil {
+		t.Fatalf("Dial() failed: %s", dialErr)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, readErr := conn.Read(make([]byte, 1))
+	if netErr, ok := readErr.(net.Error); readErr == nil || ok && netErr.Timeout() {
+		t.Fatalf("Read() = %v, want connection to be closed", readErr)
+	}
+
+	// The rejection is counted
+	if rejected := stats.TakeSnapshot().RejectedConnections; rejected != rejectedBefore+1 {
+		t.Errorf("RejectedConnections = %d, want %d", rejected, rejectedBefore+1)
+	}
+}
@@ -0,0 +1,47 @@
+package net
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// assembler collects the frames of incoming streams until they are complete
+type assembler struct {
+	streams map[uint32]*bytes.Buffer
+}
+
+// newAssembler creates an assembler without any open streams
+func newAssembler() *assembler {
+	return &assembler{
+		streams: make(map[uint32]*bytes.Buffer),
+	}
+}
+
+// add appends the payload of the given frame to its stream. If the frame completes its stream, the whole payload of
+// the stream is returned.
+func (a *assembler) add(f Frame) ([]byte, bool, error) {
+	// Find stream of this frame
+	buf, ok := a.streams[f.StreamID]
+	if !ok {
+		// Stream not yet known, make sure the peer doesn't open streams endlessly
+		if len(a.streams) >= maxOpenStreams {
+			return nil, false, fmt.Errorf("too many streams open at once")
+		}
+		buf = &bytes.Buffer{}
+		a.streams[f.StreamID] = buf
+	}
+
+	// Make sure the peer doesn't make us collect streams endlessly
+	if buf.Len()+len(f.Payload) > maxStreamSize {
+		return nil, false, fmt.Errorf("stream %d exceeds %d bytes", f.StreamID, maxStreamSize)
+	}
+	buf.Write(f.Payload)
+
+	// Check if we received the whole stream
+	if f.Flags&FlagEndOfStream == 0 {
+		return nil, false, nil
+	}
+	delete(a.streams, f.StreamID)
+
+	return buf.Bytes(), true, nil
+}
@@ -0,0 +1,55 @@
+package net
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAssemblerCollectsStream(t *testing.T) {
+	a := newAssembler()
+
+	payload, complete, addErr := a.add(Frame{StreamID: 1, Payload: []byte("foo")})
+	if addErr != nil || complete || payload != nil {
+		t.Fatalf("add(first frame) = %q, %v, %v, want incomplete stream", payload, complete, addErr)
+	}
+
+	payload, complete, addErr = a.add(Frame{StreamID: 1, Flags: FlagEndOfStream, Payload: []byte("bar")})
+	if addErr != nil || !complete || string(payload) != "foobar" {
+		t.Fatalf("add(last frame) = %q, %v, %v, want \"foobar\"", payload, complete, addErr)
+	}
+}
+
+func TestAssemblerLimitsStreamSize(t *testing.T) {
+	a := newAssembler()
+	chunk := bytes.Repeat([]byte{0}, chunkSize)
+
+	// Fill stream up to the limit without ending it
+	for i := 0; i < maxStreamSize/chunkSize; i++ {
+		_, _, addErr := a.add(Frame{StreamID: 1, Payload: chunk})
+		if addErr != nil {
+			t.Fatalf("add(chunk %d) failed below the limit: %s", i, addErr)
+		}
+	}
+
+	// A single byte more must be refused
+	_, _, addErr := a.add(Frame{StreamID: 1, Payload: []byte{0}})
+	if addErr == nil {
+		t.Fatalf("add() accepted stream exceeding %d bytes", maxStreamSize)
+	}
+}
+
+func TestAssemblerLimitsOpenStreams(t *testing.T) {
+	a := newAssembler()
+
+	for i := 0; i < maxOpenStreams; i++ {
+		_, _, addErr := a.add(Frame{StreamID: uint32(i), Payload: []byte{0}})
+		if addErr != nil {
+			t.Fatalf("add(stream %d) failed below the limit: %s", i, addErr)
+		}
+	}
+
+	_, _, addErr := a.add(Frame{StreamID: maxOpenStreams, Payload: []byte{0}})
+	if addErr == nil {
+		t.Fatalf("add() accepted more than %d open streams", maxOpenStreams)
+	}
+}
@@ -0,0 +1,231 @@
+package net
+
+import (
+	"fmt"
+	"github.com/maride/afl-transmit/stats"
+	"net"
+	"sync"
+	"time"
+)
+
+// connection wraps a single, long-lived connection between two nodes, used by both the sending and the listening side.
+// Frames may be sent from multiple goroutines at once; they are serialized by the write lock, so that multiple streams
+// are interleaved frame by frame.
+type connection struct {
+	conn            net.Conn
+	peer            string
+	remoteInstance  string
+	remoteKey       []byte
+	nonce           []byte
+	remoteNonce     []byte
+	senderID        []byte
+	sequence        uint64
+	keepalive       time.Duration
+	remoteKeepalive time.Duration
+	established     bool
+	writeLock       sync.Mutex
+	closeOnce       sync.Once
+	closed          chan struct{}
+	pendingLock     sync.Mutex
+	pending         map[uint32]chan response
+}
+
+// response is the answer of the peer to one of the streams we sent
+type response struct {
+	msgType MsgType
+	payload []byte
+	err     error
+}
+
+// newConnection wraps the given connection to the given peer
+func newConnection(conn net.Conn, peer string) *connection {
+	return &connection{
+		conn:      conn,
+		peer:      peer,
+		senderID:  newSenderID(),
+		nonce:     newNonce(),
+		keepalive: time.Duration(keepaliveInterval) * time.Second,
+		closed:    make(chan struct{}),
+		pending:   make(map[uint32]chan response),
+	}
+}
+
+// deadline returns the time after which the connection is considered dead if nothing arrives, which is three
+// intervals of the side sending pings. If that side doesn't send pings, the connection never expires - once both sides
+// exchanged hello messages, that is.
+func (c *connection) deadline() time.Time {
+	if !c.established {
+		return time.Now().Add(handshakeTimeout)
+	}
+	if c.keepalive <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(3 * c.keepalive)
+}
+
+// remote returns the address of the other end of the connection
+func (c *connection) remote() string {
+	return c.conn.RemoteAddr().String()
+}
+
+// send signs archives and encrypts the payload of the given frame if desired, and writes it to the connection
+func (c *connection) send(f Frame) error {
+	// Mark encrypted frames first - the signature covers the flags as they are sent
+	if CryptApplicable() {
+		f.Flags |= FlagEncrypted
+	}
+
+	// Sign archives, so the peer knows they are from us
+	if isArchive(f.Type) {
+		f = signFrame(f, c.remoteNonce)
+	}
+
+	// Only one frame may be written at a time
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	// Encrypt payload if desired. This is done while holding the write lock, so sequence numbers arrive in order.
+	if CryptApplicable() {
+		c.sequence++
+		var encryptErr error
+		f.Payload, encryptErr = sealPayload(f.Payload, authenticatedHeader(f), c.senderID, c.sequence)
+		if encryptErr != nil {
+			return fmt.Errorf("failed to encrypt frame for %s: %s", c.remote(), encryptErr)
+		}
+	}
+
+	// Write frame, but don't wait forever on a stuck peer
+	c.conn.SetWriteDeadline(c.deadline())
+	writeErr := WriteFrame(c.conn, f)
+	if writeErr != nil {
+		// We might have written a partial frame, so the connection is unusable from now on
+		c.close()
+		return writeErr
+	}
+
+	// Push written bytes to stats
+	written := uint64(frameHeaderSize + len(f.Payload))
+	stats.PushStat(stats.Stat{SentBytes: written})
+	stats.PushPeerStat(c.peer, stats.PeerStat{SentBytes: written})
+
+	return nil
+}
+
+// receive reads a single frame from the connection, decrypts its payload if desired and checks its signature, if any.
+// Whether the frame needed to be signed is up to the caller, see checkSigner.
+// If no frame arrives in time, the connection is considered dead.
+func (c *connection) receive() (Frame, error) {
+	// Read frame
+	c.conn.SetReadDeadline(c.deadline())
+	f, readErr := ReadFrame(c.conn)
+	if readErr != nil {
+		return Frame{}, readErr
+	}
+
+	// Push read bytes to stats
+	read := uint64(frameHeaderSize + len(f.Payload))
+	stats.PushStat(stats.Stat{ReceivedBytes: read})
+	stats.PushPeerStat(c.peer, stats.PeerStat{ReceivedBytes: read})
+
+	// Make sure the peer encrypts just like we do
+	cryptErr := checkEncryption(f)
+	if cryptErr != nil {
+		stats.PushStat(stats.Stat{CryptMismatches: 1})
+		return Frame{}, cryptErr
+	}
+
+	// Decrypt payload if desired
+	if CryptApplicable() {
+		var decryptErr error
+		f.Payload, decryptErr = openPayload(f.Payload, authenticatedHeader(f))
+		if decryptErr != nil {
+			return Frame{}, fmt.Errorf("failed to decrypt frame: %s", decryptErr)
+		}
+	}
+
+	// Check signature
+	return verifyFrame(f, c.remoteKey, c.nonce)
+}
+
+// cryptMismatchError is returned if the peer encrypts its traffic and we don't, or vice versa
+type cryptMismatchError struct {
+	message string
+}
+
+// Error returns the error message
+func (e *cryptMismatchError) Error() string {
+	return e.message
+}
+
+// checkEncryption checks if the given frame is encrypted if and only if we encrypt our traffic
+func checkEncryption(f Frame) error {
+	encrypted := f.Flags&FlagEncrypted != 0
+	if encrypted && !CryptApplicable() {
+		return &cryptMismatchError{"peer encrypts its traffic, but we don't have a key - please use the same key on all nodes"}
+	} else if !encrypted && CryptApplicable() {
+		return &cryptMismatchError{"peer sends plaintext, but we require encryption - please use the same key on all nodes"}
+	}
+	return nil
+}
+
+// expectResponse registers that we expect the peer to answer the stream with the given ID, and returns the channel the
+// answer will be delivered on
+func (c *connection) expectResponse(streamID uint32) chan response {
+	r := make(chan response, 1)
+
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+
+	// Check if the connection is closed already - then nobody is going to answer anything
+	if c.isClosed() {
+		r <- response{err: fmt.Errorf("connection closed before stream %d was answered", streamID)}
+		return r
+	}
+	c.pending[streamID] = r
+
+	return r
+}
+
+// deliverResponse delivers the given, fully received answer to whoever waits for it
+func (c *connection) deliverResponse(streamID uint32, msgType MsgType, payload []byte) {
+	c.pendingLock.Lock()
+	r, ok := c.pending[streamID]
+	delete(c.pending, streamID)
+	c.pendingLock.Unlock()
+
+	// Check if someone waits for this answer at all
+	if !ok {
+		return
+	}
+
+	r <- response{
+		msgType: msgType,
+		payload: payload,
+	}
+}
+
+// close closes the connection. It is safe to call close multiple times.
+func (c *connection) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+
+		// Nobody is going to answer anything on this connection anymore
+		c.pendingLock.Lock()
+		for id, r := range c.pending {
+			r <- response{err: fmt.Errorf("connection closed before stream %d was answered", id)}
+			delete(c.pending, id)
+		}
+		c.pendingLock.Unlock()
+	})
+}
+
+// isClosed checks if the connection was closed already
+func (c *connection) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,27 @@
+package net
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDeadlineWithoutKeepalive(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	c := newConnection(server, "test")
+	c.keepalive = 0
+
+	// The hello exchange must time out even if keepalives are disabled
+	if d := c.deadline(); d.IsZero() || d.After(time.Now().Add(handshakeTimeout)) {
+		t.Errorf("deadline() during handshake = %s, want at most %s from now", d, handshakeTimeout)
+	}
+
+	// Established connections without keepalive never expire
+	c.established = true
+	if d := c.deadline(); !d.IsZero() {
+		t.Errorf("deadline() of established connection without keepalive = %s, want none", d)
+	}
+}
@@ -1,3 +1,38 @@
 package net
 
+import "time"
+
 const ServerPort = 1337
+
+// ProtocolVersion is the version of the wire format spoken by this build, see frame.go
+const ProtocolVersion = 12
+
+const (
+	// chunkSize is the maximum number of payload bytes put into a single frame of a stream
+	chunkSize = 64 * 1024
+
+	// dialTimeout is the time we wait for a peer to accept our connection
+	dialTimeout = 10 * time.Second
+
+	// handshakeTimeout is the time we wait for the other side to exchange hello messages, regardless of --keepalive
+	handshakeTimeout = dialTimeout
+
+	// maxBackoff is the longest time we wait before trying to reconnect to an unreachable peer
+	maxBackoff = 2 * time.Minute
+
+	// indexRefreshInterval is the time between two scans of the local fuzzers for queue entries we already have
+	indexRefreshInterval = time.Minute
+
+	// ackTimeout is the time we wait for a peer to answer a stream we sent, e.g. to process an archive
+	ackTimeout = 10 * time.Minute
+
+	// maxOpenStreams is the number of streams a single connection may have open at the same time
+	maxOpenStreams = 64
+
+	// maxInventoryHashes is the number of hashes asked for in a single inventory request
+	maxInventoryHashes = 64 * 1024
+
+	// maxStreamSize is the number of bytes a single stream collected in memory may have, which is enough for an
+	// inventory request of maxInventoryHashes SHA-256 hashes. Archives are not collected, but unpacked while they arrive.
+	maxStreamSize = maxInventoryHashes * 32
+)
@@ -4,83 +4,321 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
 )
 
 var (
 	key string
-	sharedGCM cipher.AEAD
-	nonceSize int
+	keyFile string
+	passphraseFile string
+	meshID string
+	keys atomic.Value
 )
 
+// keyring holds the keys we accept, identified by their key ID, and the key we encrypt with.
+// A keyring is never changed once it is in use; reloading the keys replaces the whole keyring.
+type keyring struct {
+	current *cryptKey
+	keys    map[uint32]*cryptKey
+}
+
+// cryptKey is a single symmetric key
+type cryptKey struct {
+	id   uint32
+	aead cipher.AEAD
+}
+
 // RegisterCryptFlags Registers the flags required for cryptography
 func RegisterCryptFlags() {
-	flag.StringVar(&key, "key", "", "32 random bytes, base64-wrapped, to AES-encrypt traffic between nodes")
+	flag.StringVar(&key, "key", "", "32 random bytes, base64-wrapped, to AES-encrypt traffic between nodes. Multiple keys may be given comma-separated, the first one is used to encrypt, all of them to decrypt. Prefer --key-file, as the key is visible to other users here")
+	flag.StringVar(&keyFile, "key-file", "", "File which contains the key, as written by the keygen command. The file may contain multiple keys, one per line, the first one is used to encrypt. Reloaded on SIGHUP")
+	flag.StringVar(&passphraseFile, "passphrase-file", "", "File which contains a passphrase to derive the key from, instead of using --key or --key-file. Like --key-file, it may contain multiple passphrases, one per line")
+	flag.StringVar(&meshID, "mesh-id", "afl-transmit", "Name of your mesh, used as salt when deriving the key from a passphrase and to tell meshes apart in --discover. Must be the same on all nodes")
 }
 
-// InitCrypt creates a cipher object out of the key handed over via --key
+// InitCrypt creates cipher objects out of the keys handed over via --key, --key-file or --passphrase-file
 func InitCrypt() error {
-	// Check if a key was handed over
-	if key == "" {
+	// Get the keys from wherever the user put them
+	rawKeys, keyErr := readKeys()
+	if keyErr != nil {
+		return keyErr
+	}
+	if len(rawKeys) == 0 {
 		// no key, no service
 		return nil
 	}
 
-	// Unwrap base64'ed crypto bytes
-	rawKey, base64Err := base64.StdEncoding.DecodeString(key)
+	// Create cipher objects using those keys
+	ring, ringErr := newKeyring(rawKeys)
+	if ringErr != nil {
+		return ringErr
+	}
+	keys.Store(ring)
+
+	log.Printf("Encrypting with key %08x, accepting %d keys", ring.current.id, len(ring.keys))
+
+	// No error to report
+	return nil
+}
+
+// ReloadCrypt reads the keys again, e.g. after the user added a new key to the key file. Switching between encrypted
+// and unencrypted traffic requires a restart.
+func ReloadCrypt() error {
+	// Check if we encrypt at all
+	if !CryptApplicable() {
+		return nil
+	}
+
+	// Read new keys
+	rawKeys, keyErr := readKeys()
+	if keyErr != nil {
+		return keyErr
+	}
+	if len(rawKeys) == 0 {
+		return fmt.Errorf("no keys given, keeping the current keys")
+	}
+	ring, ringErr := newKeyring(rawKeys)
+	if ringErr != nil {
+		return ringErr
+	}
+
+	// Switch to the new keys
+	keys.Store(ring)
+	log.Printf("Reloaded keys, encrypting with key %08x, accepting %d keys", ring.current.id, len(ring.keys))
+
+	return nil
+}
+
+// newKeyring creates cipher objects for the given keys, the first one becoming the current key
+func newKeyring(rawKeys [][]byte) (*keyring, error) {
+	ring := &keyring{
+		keys: make(map[uint32]*cryptKey),
+	}
+
+	for _, rawKey := range rawKeys {
+		// Create cipher object using that key
+		block, cipherErr := aes.NewCipher(rawKey)
+		if cipherErr != nil {
+			return nil, fmt.Errorf("failed to use your key as AES256 key: %s", cipherErr)
+		}
+
+		// Create GCM with cipher object
+		gcm, gcmErr := cipher.NewGCM(block)
+		if gcmErr != nil {
+			return nil, fmt.Errorf("failed to create GCM for your key: %s", gcmErr)
+		}
+
+		// Identify key by its hash, so the receiver knows which key to decrypt with
+		sum := sha256.Sum256(rawKey)
+		k := &cryptKey{
+			id:   binary.BigEndian.Uint32(sum[:4]),
+			aead: gcm,
+		}
+		if ring.current == nil {
+			ring.current = k
+		}
+		ring.keys[k.id] = k
+	}
+
+	return ring, nil
+}
+
+// readKeys returns the keys given by the user, the current key first, or nil if none were given
+func readKeys() ([][]byte, error) {
+	// Make sure the keys are given only once
+	given := 0
+	for _, source := range []string{key, keyFile, passphraseFile} {
+		if source != "" {
+			given++
+		}
+	}
+	if given > 1 {
+		return nil, fmt.Errorf("please use only one of --key, --key-file and --passphrase-file")
+	}
+
+	var rawKeys [][]byte
+	switch {
+	case key != "":
+		for _, encoded := range strings.Split(key, ",") {
+			rawKey, decodeErr := decodeKey(strings.TrimSpace(encoded))
+			if decodeErr != nil {
+				return nil, decodeErr
+			}
+			rawKeys = append(rawKeys, rawKey)
+		}
+	case keyFile != "":
+		// Read key file, and warn if other users may read it as well
+		checkPermissions(keyFile)
+		lines, readErr := readLines(keyFile)
+		if readErr != nil {
+			return nil, fmt.Errorf("failed to read key file: %s", readErr)
+		}
+		for _, line := range lines {
+			rawKey, decodeErr := decodeKey(line)
+			if decodeErr != nil {
+				return nil, decodeErr
+			}
+			rawKeys = append(rawKeys, rawKey)
+		}
+	case passphraseFile != "":
+		// Read passphrases, and derive the keys from them
+		checkPermissions(passphraseFile)
+		passphrases, readErr := readPassphrases(passphraseFile)
+		if readErr != nil {
+			return nil, readErr
+		}
+		for _, passphrase := range passphrases {
+			rawKeys = append(rawKeys, DeriveKey(passphrase, meshID))
+		}
+	}
+
+	return rawKeys, nil
+}
+
+// readLines reads the non-empty lines of the given file, skipping comments
+func readLines(path string) ([]string, error) {
+	rawFile, readErr := ioutil.ReadFile(path)
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(rawFile), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, nil
+}
+
+// decodeKey unwraps the given base64'ed key
+func decodeKey(encoded string) ([]byte, error) {
+	rawKey, base64Err := base64.StdEncoding.DecodeString(encoded)
 	if base64Err != nil {
-		return fmt.Errorf("failed to unpack base64'ed key: %s", base64Err)
+		return nil, fmt.Errorf("failed to unpack base64'ed key: %s", base64Err)
+	}
+	return rawKey, nil
+}
+
+// readPassphrases reads the passphrases from the given file, one per line
+func readPassphrases(path string) ([][]byte, error) {
+	lines, readErr := readLines(path)
+	if readErr != nil {
+		return nil, fmt.Errorf("failed to read passphrase file: %s", readErr)
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("passphrase file %s is empty", path)
 	}
 
-	// Create cipher object using that key
-	block, cipherErr := aes.NewCipher(rawKey)
-	if cipherErr != nil {
-		return fmt.Errorf("failed to use your key as AES256 key: %s", cipherErr)
+	var passphrases [][]byte
+	for _, line := range lines {
+		passphrases = append(passphrases, []byte(line))
 	}
 
-	// Create GCM with cipher object
-	gcm, gcmErr := cipher.NewGCM(block)
-	if gcmErr != nil {
-		return fmt.Errorf("failed to create GCM for your key: %s", gcmErr)
+	return passphrases, nil
+}
+
+// checkPermissions warns if the given secret file may be read by other users
+func checkPermissions(path string) {
+	// File modes don't tell much on Windows
+	if runtime.GOOS == "windows" {
+		return
 	}
 
-	// Set shared GCM instance
-	sharedGCM = gcm
-	nonceSize = gcm.NonceSize()
+	info, statErr := os.Stat(path)
+	if statErr == nil && info.Mode().Perm()&0077 != 0 {
+		log.Printf("Warning: %s may be read by other users, consider chmod 600", path)
+	}
+}
+
+// GenerateKeyFile writes a new key to the path given with --key-file, readable only for the current user. If
+// --passphrase-file is given, the key is derived from the passphrase, else a random key is generated.
+func GenerateKeyFile() error {
+	// Check where to write the key to
+	if keyFile == "" {
+		return fmt.Errorf("please specify the path of the key file using --key-file")
+	}
+
+	// Get key
+	var rawKey []byte
+	if passphraseFile != "" {
+		passphrases, readErr := readPassphrases(passphraseFile)
+		if readErr != nil {
+			return readErr
+		}
+		rawKey = DeriveKey(passphrases[0], meshID)
+	} else {
+		rawKey = make([]byte, 32)
+		_, readErr := io.ReadFull(rand.Reader, rawKey)
+		if readErr != nil {
+			return fmt.Errorf("failed to get random bytes: %s", readErr)
+		}
+	}
+
+	// Write key file, but never overwrite an existing key
+	f, openErr := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if openErr != nil {
+		return fmt.Errorf("failed to create key file: %s", openErr)
+	}
+	_, writeErr := f.WriteString(base64.StdEncoding.EncodeToString(rawKey) + "\n")
+	closeErr := f.Close()
+	if writeErr != nil {
+		return fmt.Errorf("failed to write key file: %s", writeErr)
+	} else if closeErr != nil {
+		return fmt.Errorf("failed to write key file: %s", closeErr)
+	}
 
-	// No error to report
 	return nil
 }
 
 // CryptApplicable checks if we are able to encrypt or decrypt things, means if this instance was given a proper key
 func CryptApplicable() bool {
-	// if the shared GCM object is set, we were able to get the key off user's hands, else we don't crypt
-	return sharedGCM != nil
+	// if a keyring is set, we were able to get the keys off user's hands, else we don't crypt
+	return currentKeyring() != nil
+}
+
+// currentKeyring returns the keys currently in use, or nil if we don't crypt
+func currentKeyring() *keyring {
+	ring, _ := keys.Load().(*keyring)
+	return ring
 }
 
-// Encrypt encrypts the given bytes using the symmetric key
-func Encrypt(plain []byte) ([]byte, error) {
+// encrypt encrypts the given bytes using the symmetric key. The additional data is authenticated, but not encrypted.
+func (k *cryptKey) encrypt(plain []byte, additionalData []byte) ([]byte, error) {
 	// create nonce and fill it with random bytes
-	nonce := make([]byte, nonceSize)
+	nonce := make([]byte, k.aead.NonceSize())
 	_, readErr := io.ReadFull(rand.Reader, nonce)
 	if readErr != nil {
 		return nil, fmt.Errorf("failed to get random bytes: %s", readErr)
 	}
 
 	// Encrypt plaintext
-	return sharedGCM.Seal(nonce, nonce, plain, nil), nil
+	return k.aead.Seal(nonce, nonce, plain, additionalData), nil
 }
 
-// Decrypt decrypts the given bytes using the symmetric key
-func Decrypt(enc []byte) ([]byte, error) {
+// decrypt decrypts the given bytes using the symmetric key, checking that they were encrypted along with the given
+// additional data
+func (k *cryptKey) decrypt(enc []byte, additionalData []byte) ([]byte, error) {
 	// Sanity check on input
-	if len(enc) < sharedGCM.NonceSize() {
+	nonceSize := k.aead.NonceSize()
+	if len(enc) < nonceSize {
 		return nil, fmt.Errorf("failed to decrypt packet: too short")
 	}
 
 	// Decrypt encrypted bytes
-	return sharedGCM.Open(nil, enc[:nonceSize], enc[nonceSize:], nil)
+	return k.aead.Open(nil, enc[:nonceSize], enc[nonceSize:], additionalData)
 }
@@ -0,0 +1,318 @@
+package net
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/maride/afl-transmit/stats"
+	"log"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Announcements are sent as single UDP datagrams:
+//
+//	+-------+---------+-------+--------------------------------+
+//	| magic | version | flags |             payload            |
+//	|  4 B  |   1 B   |  1 B  | announcement, maybe encrypted  |
+//	+-------+---------+-------+--------------------------------+
+//
+// If a key is given, the payload is encrypted just like the payload of frames, see replay.go. This authenticates the
+// announcement and protects against replays.
+const (
+	announcementMagic      = "AFLA"
+	announcementHeaderSize = len(announcementMagic) + 2
+	maxAnnouncementSize    = 1024
+)
+
+var (
+	discover          bool
+	discoveryAddress  string
+	discoveryInterval int
+
+	// discovered holds the peers found by discovery, and when they announced themselves the last time.
+	// It is guarded by peersLock.
+	discovered = make(map[*Peer]time.Time)
+)
+
+// announcement is sent by each node to tell others in the local network about itself
+type announcement struct {
+	// Mesh is the mesh ID of the sending node, nodes of other meshes are ignored
+	Mesh string `json:"mesh"`
+	// Instance is the instance ID of the sending node
+	Instance string `json:"instance"`
+	// Port is the port the sending node listens on
+	Port int `json:"port"`
+}
+
+// RegisterDiscoveryFlags registers the flags required for discovering peers in the local network
+func RegisterDiscoveryFlags() {
+	flag.BoolVar(&discover, "discover", false, "Find peers in the local network automatically, by announcing this node to others with the same --mesh-id. Announcements are authenticated with the key, if given")
+	flag.StringVar(&discoveryAddress, "discovery-address", "239.255.13.37:1337", "Multicast group or broadcast address to send announcements to and receive them on")
+	flag.IntVar(&discoveryInterval, "discovery-interval", 10, "Seconds between announcements. Peers are removed if they didn't announce themselves for three intervals")
+}
+
+// Discover announces this node in the local network, and adds other nodes of the mesh as peers, if desired
+func Discover() {
+	// Check if discovery is desired at all
+	if !discover {
+		return
+	}
+
+	// We would flood the network and expire all peers right away otherwise
+	if discoveryInterval <= 0 {
+		log.Printf("Not discovering peers, --discovery-interval must be at least one second")
+		return
+	}
+
+	// Resolve the address
+	group, resolveErr := net.ResolveUDPAddr("udp", discoveryAddress)
+	if resolveErr != nil {
+		log.Printf("Failed to resolve discovery address: %s", resolveErr)
+		return
+	}
+
+	// Open sockets
+	var receiver *net.UDPConn
+	var listenErr error
+	if group.IP.IsMulticast() {
+		receiver, listenErr = net.ListenMulticastUDP("udp", nil, group)
+	} else {
+		receiver, listenErr = net.ListenUDP("udp", &net.UDPAddr{Port: group.Port})
+	}
+	if listenErr != nil {
+		log.Printf("Failed to listen for announcements: %s", listenErr)
+		return
+	}
+	sender, dialErr := net.DialUDP("udp", nil, group)
+	if dialErr != nil {
+		log.Printf("Failed to open socket for announcements: %s", dialErr)
+		receiver.Close()
+		return
+	}
+
+	// Warn the user if anyone may join
+	if !CryptApplicable() {
+		log.Println("Announcements are not authenticated, every host in the local network may join the mesh. Consider using --key")
+	}
+	log.Printf("Discovering peers on %s", group)
+
+	go receiveAnnouncements(receiver)
+	go expirePeers()
+	sendAnnouncements(sender)
+}
+
+// sendAnnouncements announces this node on the given socket every --discovery-interval seconds
+func sendAnnouncements(conn *net.UDPConn) {
+	// Identify our announcements for replay protection, just like a connection
+	senderID := newSenderID()
+	var sequence uint64
+
+	for {
+		packet, buildErr := buildAnnouncement(senderID, atomic.AddUint64(&sequence, 1))
+		if buildErr != nil {
+			log.Printf("Failed to build announcement: %s", buildErr)
+		} else if _, writeErr := conn.Write(packet); writeErr != nil {
+			log.Printf("Failed to send announcement: %s", writeErr)
+		}
+
+		time.Sleep(time.Duration(discoveryInterval) * time.Second)
+	}
+}
+
+// buildAnnouncement builds the announcement of this node, encrypting it if applicable
+func buildAnnouncement(senderID []byte, sequence uint64) ([]byte, error) {
+	// Tell others the port we listen on
+	ports := listenPorts()
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("invalid --listen")
+	}
+	listenPort, _ := strconv.Atoi(ports[0])
+
+	payload, marshalErr := json.Marshal(announcement{
+		Mesh:     meshID,
+		Instance: instanceID,
+		Port:     listenPort,
+	})
+	if marshalErr != nil {
+		return nil, marshalErr
+	}
+
+	// Encrypt if desired, authenticating the header along with the payload
+	var flags uint8
+	if CryptApplicable() {
+		flags |= FlagEncrypted
+	}
+	header := append([]byte(announcementMagic), ProtocolVersion, flags)
+	if CryptApplicable() {
+		var sealErr error
+		payload, sealErr = sealPayload(payload, header, senderID, sequence)
+		if sealErr != nil {
+			return nil, sealErr
+		}
+	}
+
+	return append(header, payload...), nil
+}
+
+// receiveAnnouncements reads announcements from the given socket forever, adding the announcing nodes as peers
+func receiveAnnouncements(conn *net.UDPConn) {
+	buf := make([]byte, maxAnnouncementSize)
+
+	// Hosts whose announcements we ignore, so we don't tell the user about them on every announcement
+	ignored := make(map[string]bool)
+
+	for {
+		n, from, readErr := conn.ReadFromUDP(buf)
+		if readErr != nil {
+			log.Printf("Failed to receive announcement: %s", readErr)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		a, parseErr := parseAnnouncement(buf[:n])
+		if parseErr != nil {
+			if !ignored[from.IP.String()] {
+				log.Printf("Ignoring announcements from %s: %s", from.IP, parseErr)
+				ignored[from.IP.String()] = true
+			}
+			continue
+		}
+
+		// Ignore ourselves, and nodes of other meshes
+		if a.Instance == instanceID || a.Mesh != meshID {
+			continue
+		}
+
+		addDiscoveredPeer(net.JoinHostPort(from.IP.String(), strconv.Itoa(a.Port)))
+	}
+}
+
+// parseAnnouncement parses the given packet, decrypting it if required
+func parseAnnouncement(packet []byte) (announcement, error) {
+	var a announcement
+
+	// Check header
+	if len(packet) < announcementHeaderSize || string(packet[:len(announcementMagic)]) != announcementMagic {
+		return a, fmt.Errorf("not an announcement")
+	}
+	if packet[len(announcementMagic)] != ProtocolVersion {
+		return a, fmt.Errorf("announcement uses protocol version %d, but we use version %d", packet[len(announcementMagic)], ProtocolVersion)
+	}
+	payload := packet[announcementHeaderSize:]
+
+	// Decrypt if required - and refuse announcements which are encrypted differently than we expect
+	encrypted := packet[len(announcementMagic)+1]&FlagEncrypted != 0
+	if encrypted != CryptApplicable() {
+		return a, fmt.Errorf("announcement is not encrypted the way we are")
+	}
+	if encrypted {
+		var openErr error
+		payload, openErr = openPayload(payload, packet[:announcementHeaderSize])
+		if openErr != nil {
+			return a, openErr
+		}
+	}
+
+	unmarshalErr := json.Unmarshal(payload, &a)
+	if unmarshalErr != nil {
+		return a, fmt.Errorf("failed to parse announcement: %s", unmarshalErr)
+	}
+	if a.Port <= 0 || a.Port > 65535 {
+		return a, fmt.Errorf("invalid port %d", a.Port)
+	}
+
+	return a, nil
+}
+
+// addDiscoveredPeer adds the peer with the given address, or notes that it is still around if we know it already
+func addDiscoveredPeer(address string) {
+	// Check if we know that peer already
+	peersLock.Lock()
+	known := noteDiscoveredPeer(findPeer(joinPeers(peers, crashPeers), address))
+	peersLock.Unlock()
+	if known {
+		return
+	}
+
+	// Resolve the new peer without holding the lock, the lookup may take a while
+	p, createErr := CreatePeer(address)
+	if createErr != nil {
+		log.Printf("Ignoring discovered peer: %s", createErr)
+		return
+	}
+	p.resolve()
+
+	peersLock.Lock()
+	defer peersLock.Unlock()
+
+	// Check again - we may know the peer under another address resolving to the same IP, or it was added meanwhile
+	if noteDiscoveredPeer(matchPeer(joinPeers(peers, crashPeers), p)) {
+		return
+	}
+
+	// Add new peer
+	peers = append(peers, p)
+	discovered[p] = time.Now()
+	stats.SetRegisteredPeers(uint64(len(peers)))
+
+	log.Printf("Discovered peer %s", p.Address)
+}
+
+// noteDiscoveredPeer notes that the given peer is still around, if it was found by discovery. It returns false if
+// the peer is nil. The caller needs to hold peersLock.
+func noteDiscoveredPeer(p *Peer) bool {
+	if p == nil {
+		return false
+	}
+	if _, ok := discovered[p]; ok {
+		discovered[p] = time.Now()
+	}
+	return true
+}
+
+// discoveredPeers returns the peers found by discovery. The caller needs to hold peersLock.
+func discoveredPeers() []*Peer {
+	var ps []*Peer
+	for p := range discovered {
+		ps = append(ps, p)
+	}
+	return ps
+}
+
+// expirePeers removes discovered peers which stopped announcing themselves
+func expirePeers() {
+	expiration := 3 * time.Duration(discoveryInterval) * time.Second
+
+	for {
+		time.Sleep(time.Duration(discoveryInterval) * time.Second)
+
+		// Remove peers, but disconnect from them only after releasing the lock
+		var expired []*Peer
+		peersLock.Lock()
+		for p, lastSeen := range discovered {
+			if time.Since(lastSeen) < expiration {
+				continue
+			}
+
+			delete(discovered, p)
+			if containsPeer(peers, p) {
+				peers = removePeer(peers, p)
+				expired = append(expired, p)
+			}
+		}
+		peerCount := len(peers)
+		peersLock.Unlock()
+
+		for _, p := range expired {
+			p.session.close()
+			stats.ForgetPeer(peerLabel(p.Address))
+			log.Printf("Peer %s stopped announcing itself, removed it", p.Address)
+		}
+		if len(expired) > 0 {
+			stats.SetRegisteredPeers(uint64(peerCount))
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package net
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// A frame is the unit of transmission between two nodes. On the wire, it looks like this:
+//
+//	+-------+---------+------+-------+-----------+----------------+---------+
+//	| magic | version | type | flags | stream ID | payload length | payload |
+//	|  4 B  |   1 B   | 1 B  |  1 B  |  4 B, BE  |    4 B, BE     |   n B   |
+//	+-------+---------+------+-------+-----------+----------------+---------+
+//
+// The magic bytes make sure we are talking to an afl-transmit node at all, the version allows us to evolve the wire
+// format without silently misinterpreting packets of older or newer nodes, and the payload length allows the receiver
+// to tell a complete transfer from a truncated one.
+// Multiple streams may be transmitted over the same connection at once, their frames being interleaved. A stream is
+// identified by its stream ID, and ends with a frame carrying FlagEndOfStream.
+const (
+	frameMagic      = "AFLT"
+	frameHeaderSize = len(frameMagic) + 1 + 1 + 1 + 4 + 4
+	maxPayloadSize  = 1024 * 1024
+)
+
+// MsgType describes what the payload of a frame is about
+type MsgType uint8
+
+const (
+	// MsgPing is sent periodically to check if the connection is still alive. Its payload is the time it was sent.
+	MsgPing MsgType = iota + 1
+	// MsgPong is the answer to MsgPing, carrying the payload of the ping
+	MsgPong
+	// MsgArchive frames carry a DEFLATEd TAR archive, see logistic.PackEntries
+	MsgArchive
+	// MsgHello is the first frame sent by both sides of a connection, see handshake.go
+	MsgHello
+	// MsgAck acknowledges that the archive with the same stream ID was processed. If processing failed, the payload
+	// contains the error message.
+	MsgAck
+	// MsgInventory asks the peer which of the testcases, given as concatenated raw SHA-256 hashes, it already has
+	MsgInventory
+	// MsgInventoryReply answers MsgInventory with the same stream ID, listing the hashes of the testcases the peer has
+	MsgInventoryReply
+	// MsgFindings frames carry a DEFLATEd TAR archive of crashes and hangs, which is stored apart from the fuzzers
+	MsgFindings
+	// MsgMembers carries the view of the mesh of the sending node, see gossip.go
+	MsgMembers
+	// MsgMembersReply answers MsgMembers with the same stream ID, carrying the view of the mesh of the peer
+	MsgMembersReply
+)
+
+const (
+	// FlagEndOfStream marks the last frame of a stream
+	FlagEndOfStream uint8 = 1 << iota
+	// FlagSigned marks frames whose payload ends with an Ed25519 signature of the sender, see identity.go
+	FlagSigned
+	// FlagEncrypted marks frames whose payload is encrypted, see replay.go. It allows the receiver to tell a peer with a
+	// different encryption setting from a broken connection.
+	FlagEncrypted
+)
+
+// Frame is a single message sent over the wire
+type Frame struct {
+	Type     MsgType
+	Flags    uint8
+	StreamID uint32
+	Payload  []byte
+}
+
+// WriteFrame writes the given frame to w, prefixed with the frame header
+func WriteFrame(w io.Writer, f Frame) error {
+	// Sanity check on payload size
+	if len(f.Payload) > maxPayloadSize {
+		return fmt.Errorf("payload of %d bytes exceeds maximum frame size", len(f.Payload))
+	}
+
+	// Build header
+	header := make([]byte, frameHeaderSize)
+	copy(header, frameMagic)
+	header[4] = ProtocolVersion
+	header[5] = uint8(f.Type)
+	header[6] = f.Flags
+	binary.BigEndian.PutUint32(header[7:], f.StreamID)
+	binary.BigEndian.PutUint32(header[11:], uint32(len(f.Payload)))
+
+	// Write header and payload
+	_, writeErr := w.Write(append(header, f.Payload...))
+	if writeErr != nil {
+		return fmt.Errorf("failed to write frame: %s", writeErr)
+	}
+
+	return nil
+}
+
+// ReadFrame reads a single frame from r, returning an error if the frame is malformed, incomplete or of a protocol
+// version we don't speak. If the connection was closed cleanly between two frames, io.EOF is returned.
+func ReadFrame(r io.Reader) (Frame, error) {
+	// Read header
+	header := make([]byte, frameHeaderSize)
+	_, headerErr := io.ReadFull(r, header)
+	if headerErr == io.EOF {
+		// Connection closed between two frames, that's fine
+		return Frame{}, io.EOF
+	} else if headerErr != nil {
+		return Frame{}, fmt.Errorf("failed to read frame header: %s", headerErr)
+	}
+
+	// Check magic bytes
+	if !bytes.Equal(header[:4], []byte(frameMagic)) {
+		return Frame{}, fmt.Errorf("invalid frame magic %q, not an afl-transmit node?", header[:4])
+	}
+
+	// Check protocol version
+	if header[4] != ProtocolVersion {
+		return Frame{}, &versionMismatchError{header[4]}
+	}
+
+	// Check payload length
+	payloadLen := binary.BigEndian.Uint32(header[11:])
+	if payloadLen > maxPayloadSize {
+		return Frame{}, fmt.Errorf("frame announces payload of %d bytes, which exceeds maximum frame size", payloadLen)
+	}
+
+	// Read payload
+	payload := make([]byte, payloadLen)
+	_, payloadErr := io.ReadFull(r, payload)
+	if payloadErr != nil {
+		return Frame{}, fmt.Errorf("failed to read frame payload of %d bytes: %s", payloadLen, payloadErr)
+	}
+
+	return Frame{
+		Type:     MsgType(header[5]),
+		Flags:    header[6],
+		StreamID: binary.BigEndian.Uint32(header[7:]),
+		Payload:  payload,
+	}, nil
+}
+
+// authenticatedHeader returns the parts of the header of the given frame which are covered by encryption and
+// signatures: type, flags and stream ID
+func authenticatedHeader(f Frame) []byte {
+	header := make([]byte, 6)
+	header[0] = uint8(f.Type)
+	header[1] = f.Flags
+	binary.BigEndian.PutUint32(header[2:], f.StreamID)
+	return header
+}
+
+// versionMismatchError is returned by ReadFrame if the other side speaks another protocol version than we do
+type versionMismatchError struct {
+	version uint8
+}
+
+// Error returns the error message
+func (e *versionMismatchError) Error() string {
+	return fmt.Sprintf("peer speaks protocol version %d, but we speak version %d - please update all nodes to the same version of afl-transmit", e.version, ProtocolVersion)
+}
@@ -0,0 +1,84 @@
+package net
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// encodeFrame returns the given frame as written by WriteFrame
+func encodeFrame(t *testing.T, f Frame) []byte {
+	var buf bytes.Buffer
+	writeErr := WriteFrame(&buf, f)
+	if writeErr != nil {
+		t.Fatalf("WriteFrame() failed: %s", writeErr)
+	}
+	return buf.Bytes()
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []Frame{
+		{Type: MsgPing, StreamID: 0, Payload: []byte{}},
+		{Type: MsgArchive, Flags: FlagEndOfStream | FlagSigned, StreamID: 42, Payload: []byte("payload")},
+		{Type: MsgMembersReply, Flags: FlagEncrypted, StreamID: 0xffffffff, Payload: bytes.Repeat([]byte{0xaa}, maxPayloadSize)},
+	}
+
+	for _, want := range tests {
+		got, readErr := ReadFrame(bytes.NewReader(encodeFrame(t, want)))
+		if readErr != nil {
+			t.Errorf("ReadFrame() of frame of type %d failed: %s", want.Type, readErr)
+			continue
+		}
+		if got.Type != want.Type || got.Flags != want.Flags || got.StreamID != want.StreamID || !bytes.Equal(got.Payload, want.Payload) {
+			t.Errorf("ReadFrame() = type %d, flags %d, stream %d, %d bytes, want type %d, flags %d, stream %d, %d bytes", got.Type, got.Flags, got.StreamID, len(got.Payload), want.Type, want.Flags, want.StreamID, len(want.Payload))
+		}
+	}
+}
+
+func TestReadFrameRefusesMalformedFrames(t *testing.T) {
+	valid := encodeFrame(t, Frame{Type: MsgArchive, StreamID: 1, Payload: []byte("payload")})
+
+	// modify returns a copy of the valid frame, changed by the given function
+	modify := func(change func(b []byte)) []byte {
+		b := append([]byte(nil), valid...)
+		change(b)
+		return b
+	}
+
+	tests := []struct {
+		name string
+		raw  []byte
+	}{
+		{"truncated header", valid[:frameHeaderSize-1]},
+		{"truncated payload", valid[:len(valid)-1]},
+		{"bad magic", modify(func(b []byte) { b[0] = 'X' })},
+		{"wrong version", modify(func(b []byte) { b[4] = ProtocolVersion + 1 })},
+		{"oversized length", modify(func(b []byte) { binary.BigEndian.PutUint32(b[11:], maxPayloadSize+1) })},
+	}
+
+	for _, test := range tests {
+		_, readErr := ReadFrame(bytes.NewReader(test.raw))
+		if readErr == nil || readErr == io.EOF {
+			t.Errorf("%s: ReadFrame() = %v, want error", test.name, readErr)
+		}
+	}
+}
+
+func TestReadFrameReturnsEOFBetweenFrames(t *testing.T) {
+	_, readErr := ReadFrame(bytes.NewReader(nil))
+	if readErr != io.EOF {
+		t.Errorf("ReadFrame() of empty stream = %v, want io.EOF", readErr)
+	}
+}
+
+func TestWriteFrameRefusesOversizedPayload(t *testing.T) {
+	var buf bytes.Buffer
+	writeErr := WriteFrame(&buf, Frame{Type: MsgArchive, Payload: make([]byte, maxPayloadSize+1)})
+	if writeErr == nil {
+		t.Errorf("WriteFrame() accepted payload of %d bytes", maxPayloadSize+1)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("WriteFrame() wrote %d bytes of an oversized frame", buf.Len())
+	}
+}
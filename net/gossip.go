@@ -0,0 +1,439 @@
+package net
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"github.com/maride/afl-transmit/stats"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// Members are considered failed if their heartbeat didn't increase for this many gossip intervals, and forgotten
+// after the same time again
+const failureIntervals = 5
+
+var (
+	gossip         bool
+	gossipInterval int
+
+	// members holds what we know about the other nodes of the mesh, by their instance ID - the same node may be known
+	// under different addresses, e.g. by hostname and by IP. It is guarded by peersLock.
+	members = make(map[string]*member)
+
+	// heartbeat is increased with each gossip round, telling others that we are still alive. It is guarded by
+	// peersLock.
+	heartbeat uint64
+)
+
+// member is a node of the mesh, as known from gossip
+type member struct {
+	// Address is the address the node listens on
+	Address string `json:"address"`
+	// Instance is the instance ID of the node
+	Instance string `json:"instance"`
+	// Heartbeat is the last heartbeat of the node we heard of
+	Heartbeat uint64 `json:"heartbeat"`
+	// Failed is set if the heartbeat of the node didn't increase for too long
+	Failed bool `json:"failed,omitempty"`
+	// Age is the number of seconds since the heartbeat of the node last increased
+	Age float64 `json:"age"`
+
+	// updated is the time the heartbeat of the node last increased
+	updated time.Time
+	// peer is the peer we added for the node, if it wasn't a peer already
+	peer *Peer
+}
+
+// gossipMessage is exchanged by two nodes in a gossip round, see MsgMembers
+type gossipMessage struct {
+	// Port is the port the sending node listens on. It is 0 for queries of the members command, which are not merged.
+	Port int `json:"port"`
+	// Heartbeat is the current heartbeat of the sending node
+	Heartbeat uint64 `json:"heartbeat"`
+	// Members are the other nodes the sending node knows of
+	Members []member `json:"members"`
+}
+
+// RegisterGossipFlags registers the flags required for gossip membership
+func RegisterGossipFlags() {
+	flag.BoolVar(&gossip, "gossip", false, "Exchange the list of known nodes with peers, so every node eventually knows all nodes of the mesh, and adds them as peers. Requires --key or TLS")
+	flag.IntVar(&gossipInterval, "gossip-interval", 10, "Seconds between gossip rounds. Nodes are considered failed if they didn't take part in gossip for five intervals")
+}
+
+// InitGossip checks if gossip can be used as configured
+func InitGossip() error {
+	// Check if gossip is desired at all
+	if !gossip {
+		return nil
+	}
+
+	// Only members of the mesh should be able to change its membership
+	if !CryptApplicable() && !TLSApplicable() {
+		return fmt.Errorf("--gossip requires --key or TLS, as anyone could join the mesh otherwise")
+	}
+
+	// We would flood our peers and declare all members as failed right away otherwise
+	if gossipInterval <= 0 {
+		return fmt.Errorf("--gossip-interval must be at least one second, got %d", gossipInterval)
+	}
+
+	return nil
+}
+
+// Gossip periodically exchanges the list of known nodes with a random peer, adding new nodes as peers and removing
+// failed ones, if desired
+func Gossip() {
+	// Check if gossip is desired at all
+	if !gossip {
+		return
+	}
+
+	for {
+		time.Sleep(time.Duration(gossipInterval) * time.Second)
+
+		// Tell others we are still alive, and check if others are
+		detectFailures()
+
+		// Pick a random peer to talk to
+		ps := currentPeers()
+		if len(ps) == 0 {
+			continue
+		}
+		p := ps[rand.Intn(len(ps))]
+
+		gossipErr := p.exchangeMembers()
+		if gossipErr != nil {
+			log.Printf("Failed to gossip with peer %s: %s", p.Address, gossipErr)
+		}
+	}
+}
+
+// exchangeMembers sends the nodes we know of to the peer, and merges the nodes the peer knows of
+func (p *Peer) exchangeMembers() error {
+	// Get connection to peer
+	c, connErr := p.session.connection()
+	if connErr != nil {
+		return connErr
+	}
+
+	// Send our view of the mesh
+	request, marshalErr := json.Marshal(ownGossipMessage())
+	if marshalErr != nil {
+		return fmt.Errorf("failed to build gossip message: %s", marshalErr)
+	}
+	reply, replyErr := p.session.request(c, MsgMembers, request)
+	if replyErr != nil {
+		return replyErr
+	}
+
+	// Merge the view of the peer
+	var m gossipMessage
+	unmarshalErr := json.Unmarshal(reply, &m)
+	if unmarshalErr != nil {
+		return fmt.Errorf("failed to parse gossip message: %s", unmarshalErr)
+	}
+	mergeMembers(p.Address, c.remoteInstance, m)
+
+	return nil
+}
+
+// Answers the gossip message of a peer with our own view of the mesh, and merges the view of the peer
+func answerMembers(c *connection, streamID uint32, request []byte) {
+	s := newReplyStream(c, streamID, MsgMembersReply)
+	answerErr := func() error {
+		// Check if gossip is desired at all
+		if !gossip {
+			return fmt.Errorf("gossip is disabled on this node")
+		}
+
+		// Parse message
+		var m gossipMessage
+		unmarshalErr := json.Unmarshal(request, &m)
+		if unmarshalErr != nil {
+			return fmt.Errorf("failed to parse gossip message: %s", unmarshalErr)
+		}
+
+		// Merge the view of the peer, unless it only wants to know ours
+		if m.Port != 0 {
+			host, _, splitErr := net.SplitHostPort(c.remote())
+			if splitErr != nil {
+				return splitErr
+			}
+			mergeMembers(net.JoinHostPort(host, strconv.Itoa(m.Port)), c.remoteInstance, m)
+		}
+
+		return nil
+	}()
+
+	// Send reply - or tell the peer what went wrong
+	var writeErr error
+	if answerErr != nil {
+		writeErr = c.send(Frame{Type: MsgAck, Flags: FlagEndOfStream, StreamID: streamID, Payload: []byte(answerErr.Error())})
+	} else {
+		reply, marshalErr := json.Marshal(ownGossipMessage())
+		if marshalErr != nil {
+			log.Printf("Failed to build gossip message: %s", marshalErr)
+			return
+		}
+		_, writeErr = s.Write(reply)
+		if writeErr == nil {
+			writeErr = s.Close()
+		}
+	}
+	if writeErr != nil {
+		log.Printf("Failed to answer gossip of %s: %s", c.remote(), writeErr)
+	}
+}
+
+// ownGossipMessage returns our view of the mesh
+func ownGossipMessage() gossipMessage {
+	// Tell others the port we listen on
+	ports := listenPorts()
+	listenPort := 0
+	if len(ports) > 0 {
+		listenPort, _ = strconv.Atoi(ports[0])
+	}
+
+	peersLock.RLock()
+	defer peersLock.RUnlock()
+
+	m := gossipMessage{
+		Port:      listenPort,
+		Heartbeat: heartbeat,
+	}
+	for _, mem := range members {
+		entry := *mem
+		entry.Age = time.Since(mem.updated).Seconds()
+		m.Members = append(m.Members, entry)
+	}
+
+	return m
+}
+
+// mergeMembers merges the view of the mesh of the node with the given address and instance ID into ours
+func mergeMembers(address string, instance string, m gossipMessage) {
+	peersLock.Lock()
+
+	// The node itself is the best source of information about itself
+	var newMembers []*member
+	if mem := mergeMember(member{Address: address, Instance: instance, Heartbeat: m.Heartbeat}, true); mem != nil {
+		newMembers = append(newMembers, mem)
+	}
+
+	for _, entry := range m.Members {
+		if entry.Failed {
+			// We detect failures on our own
+			continue
+		}
+		if mem := mergeMember(entry, false); mem != nil {
+			newMembers = append(newMembers, mem)
+		}
+	}
+
+	peersLock.Unlock()
+
+	// Add new members as peers - this may look up hostnames, so we don't hold the lock meanwhile
+	for _, mem := range newMembers {
+		addMemberPeer(mem)
+	}
+}
+
+// mergeMember merges the given information about a node into ours. If direct is set, the information comes from the
+// node itself. Returns the member if it needs to be added as peer. The caller needs to hold peersLock.
+func mergeMember(entry member, direct bool) *member {
+	// Ignore ourselves, and nonsense
+	if entry.Instance == instanceID || entry.Instance == "" {
+		return nil
+	}
+	address, parseErr := parseAddress(entry.Address, ServerPort)
+	if parseErr != nil {
+		return nil
+	}
+
+	// Check if we know the node already
+	mem, ok := members[entry.Instance]
+	if !ok {
+		mem = &member{Address: address, Instance: entry.Instance, Heartbeat: entry.Heartbeat, updated: time.Now()}
+
+		// A node gets a new instance ID if it restarts. If the node tells us itself, we don't need to wait for the old
+		// instance to fail.
+		restarted := false
+		if direct {
+			for instance, old := range members {
+				if old.Address == address {
+					mem.peer = old.peer
+					delete(members, instance)
+					restarted = true
+				}
+			}
+		}
+		members[entry.Instance] = mem
+		if restarted {
+			log.Printf("Member %s restarted", address)
+		} else {
+			log.Printf("Member %s joined", address)
+		}
+
+		return needsPeer(mem)
+	}
+
+	// Check if the node is still alive
+	if entry.Heartbeat <= mem.Heartbeat {
+		return nil
+	}
+	mem.Heartbeat = entry.Heartbeat
+	mem.updated = time.Now()
+	if mem.Failed {
+		mem.Failed = false
+		log.Printf("Member %s is alive again", mem.Address)
+		return needsPeer(mem)
+	}
+	return nil
+}
+
+// needsPeer returns the given member if it is neither a peer already nor failed, or nil otherwise. The caller needs
+// to hold peersLock.
+func needsPeer(mem *member) *member {
+	if mem.peer != nil || mem.Failed || findPeer(joinPeers(peers, crashPeers), mem.Address) != nil {
+		return nil
+	}
+	return mem
+}
+
+// addMemberPeer adds the given member as peer, unless it is a peer already - either under the same address, or under
+// another address resolving to the same IP
+func addMemberPeer(mem *member) {
+	// Look up the peer without holding the lock
+	p, createErr := CreatePeer(mem.Address)
+	if createErr != nil {
+		log.Printf("Ignoring member: %s", createErr)
+		return
+	}
+	p.resolve()
+
+	peersLock.Lock()
+	defer peersLock.Unlock()
+
+	// Check again, the member may have changed meanwhile
+	if members[mem.Instance] != mem || needsPeer(mem) == nil || matchPeer(joinPeers(peers, crashPeers), p) != nil {
+		return
+	}
+	peers = append(peers, p)
+	mem.peer = p
+	stats.SetRegisteredPeers(uint64(len(peers)))
+}
+
+// memberPeers returns the peers we added for members. The caller needs to hold peersLock.
+func memberPeers() []*Peer {
+	var ps []*Peer
+	for _, mem := range members {
+		if mem.peer != nil {
+			ps = append(ps, mem.peer)
+		}
+	}
+	return ps
+}
+
+// detectFailures increases our heartbeat, marks members as failed if their heartbeat didn't increase for too long,
+// and forgets members which failed long ago
+func detectFailures() {
+	// Stop talking to failed members, but disconnect from them only after releasing the lock
+	var failed []*Peer
+	defer func() {
+		for _, p := range failed {
+			p.session.close()
+			stats.ForgetPeer(peerLabel(p.Address))
+		}
+	}()
+
+	peersLock.Lock()
+	defer peersLock.Unlock()
+
+	heartbeat++
+
+	timeout := failureIntervals * time.Duration(gossipInterval) * time.Second
+	for instance, mem := range members {
+		silence := time.Since(mem.updated)
+
+		// Forget members which failed long ago
+		if mem.Failed && silence > 2*timeout {
+			delete(members, instance)
+			log.Printf("Forgot failed member %s", mem.Address)
+			continue
+		}
+
+		// Mark members as failed if they are silent for too long, and stop talking to them
+		if !mem.Failed && silence > timeout {
+			mem.Failed = true
+			log.Printf("Member %s failed, last heard of %s ago", mem.Address, silence.Round(time.Second))
+
+			if mem.peer != nil {
+				if containsPeer(peers, mem.peer) {
+					peers = removePeer(peers, mem.peer)
+					failed = append(failed, mem.peer)
+					stats.SetRegisteredPeers(uint64(len(peers)))
+				}
+				mem.peer = nil
+			}
+		}
+	}
+}
+
+// PrintMembers asks the node running on this host for the members of the mesh, and prints them as a table
+func PrintMembers(w io.Writer) error {
+	// Connect to the node like a peer would
+	addresses, addressesErr := listenAddresses()
+	if addressesErr != nil {
+		return addressesErr
+	}
+	address := addresses[0]
+	if host, listenPort, _ := net.SplitHostPort(address); host == "" {
+		address = net.JoinHostPort("localhost", listenPort)
+	}
+	p, createErr := CreatePeer(address)
+	if createErr != nil {
+		return createErr
+	}
+	c, connErr := p.session.connection()
+	if connErr != nil {
+		return connErr
+	}
+	defer p.session.close()
+
+	// Ask for the members
+	request, _ := json.Marshal(gossipMessage{})
+	reply, replyErr := p.session.request(c, MsgMembers, request)
+	if replyErr != nil {
+		return replyErr
+	}
+	var m gossipMessage
+	unmarshalErr := json.Unmarshal(reply, &m)
+	if unmarshalErr != nil {
+		return fmt.Errorf("failed to parse gossip message: %s", unmarshalErr)
+	}
+	sort.Slice(m.Members, func(i, j int) bool {
+		return m.Members[i].Address < m.Members[j].Address
+	})
+
+	// Print table, starting with the node itself
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ADDRESS\tINSTANCE\tHEARTBEAT\tSTATUS\tLAST HEARD\t")
+	fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t\n", address, c.remoteInstance, m.Heartbeat, "self", "now")
+	for _, mem := range m.Members {
+		status := "alive"
+		if mem.Failed {
+			status = "failed"
+		}
+		lastHeard := humanize.Time(time.Now().Add(-time.Duration(mem.Age * float64(time.Second))))
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t\n", mem.Address, mem.Instance, mem.Heartbeat, status, lastHeard)
+	}
+	return tw.Flush()
+}
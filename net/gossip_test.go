@@ -0,0 +1,214 @@
+package net
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// knownMember describes a member as known before a gossip round
+type knownMember struct {
+	address   string
+	instance  string
+	heartbeat uint64
+	failed    bool
+	// silence is the time since the heartbeat of the member last increased
+	silence time.Duration
+	// peer is set if we added the member as peer
+	peer bool
+}
+
+// useTestMembers replaces the members and peers by the given ones, returning a function which clears them again
+func useTestMembers(t *testing.T, known []knownMember) func() {
+	peersLock.Lock()
+	defer peersLock.Unlock()
+
+	members = make(map[string]*member)
+	peers = nil
+	crashPeers = nil
+	heartbeat = 0
+	for _, k := range known {
+		mem := &member{Address: k.address, Instance: k.instance, Heartbeat: k.heartbeat, Failed: k.failed, updated: time.Now().Add(-k.silence)}
+		if k.peer {
+			p, createErr := CreatePeer(k.address)
+			if createErr != nil {
+				t.Fatalf("CreatePeer(%s) failed: %s", k.address, createErr)
+			}
+			p.resolve()
+			peers = append(peers, p)
+			mem.peer = p
+		}
+		members[k.instance] = mem
+	}
+
+	return func() {
+		peersLock.Lock()
+		members = make(map[string]*member)
+		peers = nil
+		heartbeat = 0
+		peersLock.Unlock()
+	}
+}
+
+// describeMembers returns the members in a comparable form, e.g. "a@192.0.2.1:1337#5 failed"
+func describeMembers() string {
+	peersLock.RLock()
+	defer peersLock.RUnlock()
+
+	var described []string
+	for _, mem := range members {
+		d := mem.Instance + "@" + mem.Address + "#" + strconv.FormatUint(mem.Heartbeat, 10)
+		if mem.Failed {
+			d += " failed"
+		}
+		described = append(described, d)
+	}
+	sort.Strings(described)
+	return strings.Join(described, ", ")
+}
+
+// describePeers returns the addresses of the peers in a comparable form
+func describePeers() string {
+	var described []string
+	for _, p := range currentPeers() {
+		described = append(described, p.Address)
+	}
+	sort.Strings(described)
+	return strings.Join(described, ", ")
+}
+
+func TestGossipRound(t *testing.T) {
+	oldInterval := gossipInterval
+	gossipInterval = 1
+	defer func() {
+		gossipInterval = oldInterval
+	}()
+
+	// Members are considered failed after five seconds of silence, and forgotten after ten seconds
+	tests := []struct {
+		name  string
+		known []knownMember
+		// from, instance and message describe the gossip we receive, if any
+		from     string
+		instance string
+		message  *gossipMessage
+		// wantMembers and wantPeers are our view after the gossip round
+		wantMembers string
+		wantPeers   string
+	}{
+		{
+			name:        "join",
+			from:        "192.0.2.1:1337",
+			instance:    "a",
+			message:     &gossipMessage{Heartbeat: 1},
+			wantMembers: "a@192.0.2.1:1337#1",
+			wantPeers:   "192.0.2.1:1337",
+		},
+		{
+			name:     "join through others",
+			from:     "192.0.2.1:1337",
+			instance: "a",
+			message: &gossipMessage{Heartbeat: 1, Members: []member{
+				{Address: "192.0.2.2", Instance: "b", Heartbeat: 3},
+				{Address: "192.0.2.3:1337", Instance: "c", Heartbeat: 4, Failed: true},
+			}},
+			wantMembers: "a@192.0.2.1:1337#1, b@192.0.2.2:1337#3",
+			wantPeers:   "192.0.2.1:1337, 192.0.2.2:1337",
+		},
+		{
+			name:        "restart under the same address",
+			known:       []knownMember{{address: "192.0.2.1:1337", instance: "a", heartbeat: 7, peer: true}},
+			from:        "192.0.2.1:1337",
+			instance:    "a2",
+			message:     &gossipMessage{Heartbeat: 1},
+			wantMembers: "a2@192.0.2.1:1337#1",
+			wantPeers:   "192.0.2.1:1337",
+		},
+		{
+			name:     "restart told by others",
+			known:    []knownMember{{address: "192.0.2.2:1337", instance: "b", heartbeat: 7, peer: true}},
+			from:     "192.0.2.1:1337",
+			instance: "a",
+			message: &gossipMessage{Heartbeat: 1, Members: []member{
+				{Address: "192.0.2.2:1337", Instance: "b2", Heartbeat: 1},
+			}},
+			wantMembers: "a@192.0.2.1:1337#1, b2@192.0.2.2:1337#1, b@192.0.2.2:1337#7",
+			wantPeers:   "192.0.2.1:1337, 192.0.2.2:1337",
+		},
+		{
+			name:        "stale heartbeat",
+			known:       []knownMember{{address: "192.0.2.1:1337", instance: "a", heartbeat: 5, silence: 6 * time.Second, peer: true}},
+			from:        "192.0.2.1:1337",
+			instance:    "a",
+			message:     &gossipMessage{Heartbeat: 5},
+			wantMembers: "a@192.0.2.1:1337#5 failed",
+			wantPeers:   "",
+		},
+		{
+			name:        "increased heartbeat",
+			known:       []knownMember{{address: "192.0.2.1:1337", instance: "a", heartbeat: 5, silence: 4 * time.Second, peer: true}},
+			from:        "192.0.2.1:1337",
+			instance:    "a",
+			message:     &gossipMessage{Heartbeat: 6},
+			wantMembers: "a@192.0.2.1:1337#6",
+			wantPeers:   "192.0.2.1:1337",
+		},
+		{
+			name:        "failure",
+			known:       []knownMember{{address: "192.0.2.1:1337", instance: "a", heartbeat: 5, silence: 6 * time.Second, peer: true}},
+			wantMembers: "a@192.0.2.1:1337#5 failed",
+			wantPeers:   "",
+		},
+		{
+			name:        "revival",
+			known:       []knownMember{{address: "192.0.2.1:1337", instance: "a", heartbeat: 5, failed: true, silence: 6 * time.Second}},
+			from:        "192.0.2.1:1337",
+			instance:    "a",
+			message:     &gossipMessage{Heartbeat: 6},
+			wantMembers: "a@192.0.2.1:1337#6",
+			wantPeers:   "192.0.2.1:1337",
+		},
+		{
+			name:        "forgetting",
+			known:       []knownMember{{address: "192.0.2.1:1337", instance: "a", heartbeat: 5, failed: true, silence: 11 * time.Second}},
+			wantMembers: "",
+			wantPeers:   "",
+		},
+	}
+
+	for _, test := range tests {
+		reset := useTestMembers(t, test.known)
+
+		if test.message != nil {
+			mergeMembers(test.from, test.instance, *test.message)
+		}
+		detectFailures()
+
+		if got := describeMembers(); got != test.wantMembers {
+			t.Errorf("%s: members = %q, want %q", test.name, got, test.wantMembers)
+		}
+		if got := describePeers(); got != test.wantPeers {
+			t.Errorf("%s: peers = %q, want %q", test.name, got, test.wantPeers)
+		}
+
+		reset()
+	}
+}
+
+func TestInitGossipRefusesInvalidInterval(t *testing.T) {
+	defer useTestKey(t)()
+	oldGossip, oldInterval := gossip, gossipInterval
+	defer func() {
+		gossip, gossipInterval = oldGossip, oldInterval
+	}()
+
+	gossip = true
+	for _, interval := range []int{0, -1} {
+		gossipInterval = interval
+		if initErr := InitGossip(); initErr == nil {
+			t.Errorf("InitGossip() accepted --gossip-interval %d", interval)
+		}
+	}
+}
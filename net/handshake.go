@@ -0,0 +1,98 @@
+package net
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// instanceID identifies this process. It changes on every start, which allows peers to notice that we restarted and
+// might have lost state they think we have.
+var instanceID = newInstanceID()
+
+// hello is exchanged by both sides right after a connection was established
+type hello struct {
+	// Instance is the instance ID of the sending node
+	Instance string `json:"instance"`
+	// PublicKey is the Ed25519 key the sending node signs its archives with, if any
+	PublicKey []byte `json:"public_key,omitempty"`
+	// Keepalive is the number of seconds between pings the sending node sends on idle connections, see --keepalive
+	Keepalive int `json:"keepalive"`
+	// Nonce is a random value the other side includes in its signatures, proving that it holds its key right now,
+	// instead of replaying frames it captured elsewhere. See signedMessage.
+	Nonce []byte `json:"nonce"`
+}
+
+// newInstanceID creates a random instance ID
+func newInstanceID() string {
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+// newNonce creates a random nonce for a new connection, see hello
+func newNonce() []byte {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	return nonce
+}
+
+// sendHello sends our hello message over the given connection
+func sendHello(c *connection) error {
+	// Build hello message
+	payload, marshalErr := json.Marshal(hello{
+		Instance:  instanceID,
+		PublicKey: publicKey(),
+		Keepalive: keepaliveInterval,
+		Nonce:     c.nonce,
+	})
+	if marshalErr != nil {
+		return fmt.Errorf("failed to build hello message: %s", marshalErr)
+	}
+
+	return c.send(Frame{Type: MsgHello, Payload: payload})
+}
+
+// receiveHello reads the hello message of the other side from the given connection, and stores the instance ID,
+// public key, keepalive interval and nonce of the other side in the connection
+func receiveHello(c *connection) error {
+	// Read frame
+	f, readErr := c.receive()
+	if isMismatch(readErr) {
+		// Keep the error as it is, so the caller can tell the peer what's wrong
+		return readErr
+	} else if readErr != nil {
+		return fmt.Errorf("failed to read hello message: %s", readErr)
+	}
+
+	// Check if it is a hello at all
+	if f.Type != MsgHello {
+		return fmt.Errorf("expected hello message, got frame of type %d", f.Type)
+	}
+
+	// Parse hello message
+	var h hello
+	unmarshalErr := json.Unmarshal(f.Payload, &h)
+	if unmarshalErr != nil {
+		return fmt.Errorf("failed to parse hello message: %s", unmarshalErr)
+	}
+	c.remoteInstance = h.Instance
+	c.remoteKey = h.PublicKey
+	c.remoteKeepalive = time.Duration(h.Keepalive) * time.Second
+	c.remoteNonce = h.Nonce
+
+	return nil
+}
+
+// isMismatch checks if the given error tells that the other side speaks another protocol version or encrypts
+// differently than we do. The other side can't tell what's wrong on its own in these cases, so we still answer it.
+func isMismatch(err error) bool {
+	switch err.(type) {
+	case *cryptMismatchError, *versionMismatchError:
+		return true
+	default:
+		return false
+	}
+}
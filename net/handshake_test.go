@@ -0,0 +1,61 @@
+package net
+
+import (
+	"bytes"
+	"github.com/maride/afl-transmit/logistic"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+// otherVersionFrame returns a frame without payload, as sent by a node speaking another protocol version
+func otherVersionFrame(t *testing.T, msgType MsgType) []byte {
+	var buf bytes.Buffer
+	writeErr := WriteFrame(&buf, Frame{Type: msgType})
+	if writeErr != nil {
+		t.Fatalf("WriteFrame() failed: %s", writeErr)
+	}
+	raw := buf.Bytes()
+	raw[4] = ProtocolVersion + 1
+	return raw
+}
+
+func TestReceiveHelloReportsVersionMismatch(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go client.Write(otherVersionFrame(t, MsgHello))
+
+	helloErr := receiveHello(newConnection(server, "test"))
+	if _, ok := helloErr.(*versionMismatchError); !ok {
+		t.Errorf("receiveHello() = %v, want version mismatch", helloErr)
+	}
+}
+
+func TestListenerAnswersOtherVersion(t *testing.T) {
+	outputDirectory, _ := ioutil.TempDir("", "afl-transmit-handshake")
+	defer os.RemoveAll(outputDirectory)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go handle(server, outputDirectory, logistic.NewHashIndex(outputDirectory))
+
+	// Say hello in another protocol version
+	_, writeErr := client.Write(otherVersionFrame(t, MsgHello))
+	if writeErr != nil {
+		t.Fatalf("Write() failed: %s", writeErr)
+	}
+
+	// The listener must still tell us its version, so we can tell what's wrong - and close the connection afterwards
+	f, readErr := ReadFrame(client)
+	if readErr != nil || f.Type != MsgHello {
+		t.Fatalf("ReadFrame() = frame of type %d, %v, want hello", f.Type, readErr)
+	}
+	_, readErr = ReadFrame(client)
+	if readErr != io.EOF {
+		t.Errorf("ReadFrame() after hello = %v, want io.EOF", readErr)
+	}
+}
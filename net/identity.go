@@ -0,0 +1,180 @@
+package net
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+var (
+	identityFile string
+	identity     ed25519.PrivateKey
+)
+
+// RegisterIdentityFlags registers the flags required for signing archives
+func RegisterIdentityFlags() {
+	flag.StringVar(&identityFile, "identity", "", "File which contains the Ed25519 key of this node, used to sign all archives sent to peers. If the file doesn't exist, a new key is generated. Peers verify the signatures if they list our public key as pubkey=<key> in their peers file")
+}
+
+// InitIdentity loads the Ed25519 key of this node, generating it if required
+func InitIdentity() error {
+	// Check if an identity was handed over
+	if identityFile == "" {
+		return nil
+	}
+
+	// Read key, or generate a new one
+	rawSeed, readErr := ioutil.ReadFile(identityFile)
+	if os.IsNotExist(readErr) {
+		seed, generateErr := generateIdentity(identityFile)
+		if generateErr != nil {
+			return generateErr
+		}
+		identity = ed25519.NewKeyFromSeed(seed)
+		log.Printf("Generated new identity in %s", identityFile)
+	} else if readErr != nil {
+		return fmt.Errorf("failed to read identity: %s", readErr)
+	} else {
+		// Unwrap base64'ed seed
+		seed, base64Err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(rawSeed)))
+		if base64Err != nil {
+			return fmt.Errorf("failed to unpack base64'ed identity: %s", base64Err)
+		}
+		if len(seed) != ed25519.SeedSize {
+			return fmt.Errorf("identity in %s is not an Ed25519 key", identityFile)
+		}
+		identity = ed25519.NewKeyFromSeed(seed)
+	}
+
+	// Tell the user how other nodes can trust us
+	log.Printf("Signing archives, the public key of this node is %s", base64.StdEncoding.EncodeToString(identity.Public().(ed25519.PublicKey)))
+
+	return nil
+}
+
+// generateIdentity generates a new Ed25519 key and writes it to the given path, readable only for us
+func generateIdentity(path string) ([]byte, error) {
+	seed := make([]byte, ed25519.SeedSize)
+	_, randErr := rand.Read(seed)
+	if randErr != nil {
+		return nil, fmt.Errorf("failed to get random bytes: %s", randErr)
+	}
+
+	writeErr := ioutil.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(seed)+"\n"), 0600)
+	if writeErr != nil {
+		return nil, fmt.Errorf("failed to write identity: %s", writeErr)
+	}
+
+	return seed, nil
+}
+
+// publicKey returns the public key of this node, or nil if we don't sign archives
+func publicKey() []byte {
+	if identity == nil {
+		return nil
+	}
+	return identity.Public().(ed25519.PublicKey)
+}
+
+// isArchive checks if frames of the given type carry archives, which are signed
+func isArchive(msgType MsgType) bool {
+	return msgType == MsgArchive || msgType == MsgFindings
+}
+
+// signFrame appends our signature to the payload of the given frame, if we have an identity. The nonce is the one the
+// receiving side sent in its hello.
+func signFrame(f Frame, nonce []byte) Frame {
+	if identity == nil {
+		return f
+	}
+
+	f.Flags |= FlagSigned
+	signature := ed25519.Sign(identity, signedMessage(f, nonce))
+	f.Payload = append(f.Payload[:len(f.Payload):len(f.Payload)], signature...)
+	return f
+}
+
+// verifyFrame checks the signature of the given frame against the given public key, and removes it from the payload.
+// The nonce is the one we sent in our hello. Frames without signature are returned as they are.
+func verifyFrame(f Frame, remoteKey []byte, nonce []byte) (Frame, error) {
+	// Check if the frame is signed at all
+	if f.Flags&FlagSigned == 0 {
+		return f, nil
+	}
+
+	// Split payload and signature
+	if len(f.Payload) < ed25519.SignatureSize {
+		return Frame{}, fmt.Errorf("signed frame is too short")
+	}
+	if len(remoteKey) != ed25519.PublicKeySize {
+		return Frame{}, fmt.Errorf("received signed frame, but the peer didn't tell us its public key")
+	}
+	signature := f.Payload[len(f.Payload)-ed25519.SignatureSize:]
+	f.Payload = f.Payload[:len(f.Payload)-ed25519.SignatureSize]
+
+	// Verify signature
+	if !ed25519.Verify(remoteKey, signedMessage(f, nonce), signature) {
+		return Frame{}, fmt.Errorf("invalid signature on frame of stream %d", f.StreamID)
+	}
+
+	return f, nil
+}
+
+// signedMessage returns what the signature of the given frame covers: the nonce of the receiving side, which binds the
+// signature to the connection, followed by type, flags, stream ID and payload of the frame
+func signedMessage(f Frame, nonce []byte) []byte {
+	message := make([]byte, 0, len(nonce)+6+len(f.Payload))
+	message = append(message, nonce...)
+	message = append(message, authenticatedHeader(f)...)
+	return append(message, f.Payload...)
+}
+
+// checkSigner checks if the given frame was signed by a trusted peer. If no peer has a public key configured, all
+// frames are accepted.
+func checkSigner(c *connection, f Frame) error {
+	// Get keys we trust
+	keys := trustedKeys()
+	if len(keys) == 0 {
+		return nil
+	}
+
+	// Check signature and signer
+	if f.Flags&FlagSigned == 0 {
+		return fmt.Errorf("archive is not signed")
+	}
+	signer := base64.StdEncoding.EncodeToString(c.remoteKey)
+	if !keys[signer] {
+		return fmt.Errorf("archive is signed by unknown key %s", signer)
+	}
+
+	return nil
+}
+
+// trustedKeys returns the public keys of all configured peers
+func trustedKeys() map[string]bool {
+	keys := make(map[string]bool)
+	for _, p := range allPeers() {
+		if p.publicKey != "" {
+			keys[p.publicKey] = true
+		}
+	}
+	return keys
+}
+
+// parsePublicKey checks if the given string is a valid Ed25519 public key, and returns it in its canonical form
+func parsePublicKey(raw string) (string, error) {
+	key, decodeErr := base64.StdEncoding.DecodeString(raw)
+	if decodeErr != nil {
+		return "", fmt.Errorf("failed to unpack base64'ed public key: %s", decodeErr)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return "", fmt.Errorf("public key %s is not an Ed25519 key", raw)
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
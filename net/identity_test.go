@@ -0,0 +1,101 @@
+package net
+
+import (
+	"crypto/ed25519"
+	"net"
+	"testing"
+)
+
+// useTestIdentity makes the node sign its archives with a new key, returning a function which stops signing again
+func useTestIdentity(t *testing.T) func() {
+	_, key, generateErr := ed25519.GenerateKey(nil)
+	if generateErr != nil {
+		t.Fatalf("GenerateKey() failed: %s", generateErr)
+	}
+	identity = key
+	return func() {
+		identity = nil
+	}
+}
+
+// connectedPair returns both ends of a connection which exchanged hello messages
+func connectedPair(t *testing.T) (*connection, *connection) {
+	clientConn, serverConn := net.Pipe()
+	client := newConnection(clientConn, "client")
+	server := newConnection(serverConn, "server")
+
+	// net.Pipe is synchronous, so one side needs to send while the other one receives
+	go sendHello(client)
+	if helloErr := receiveHello(server); helloErr != nil {
+		t.Fatalf("receiveHello() of server failed: %s", helloErr)
+	}
+	go sendHello(server)
+	if helloErr := receiveHello(client); helloErr != nil {
+		t.Fatalf("receiveHello() of client failed: %s", helloErr)
+	}
+	client.established = true
+	server.established = true
+
+	return client, server
+}
+
+// transmit sends the given frame from one end of a connection and receives it on the other end
+func transmit(from *connection, to *connection, f Frame) (Frame, error) {
+	go from.send(f)
+	return to.receive()
+}
+
+func TestSignedFrameRoundTrip(t *testing.T) {
+	defer useTestIdentity(t)()
+	client, server := connectedPair(t)
+	defer client.close()
+	defer server.close()
+
+	f, receiveErr := transmit(client, server, Frame{Type: MsgArchive, StreamID: 1, Payload: []byte("archive")})
+	if receiveErr != nil {
+		t.Fatalf("receive() of signed frame failed: %s", receiveErr)
+	}
+	if f.Flags&FlagSigned == 0 || string(f.Payload) != "archive" {
+		t.Errorf("receive() = flags %d, %q, want signed \"archive\"", f.Flags, f.Payload)
+	}
+}
+
+func TestSignedFrameIsBoundToConnection(t *testing.T) {
+	defer useTestIdentity(t)()
+
+	// Capture a signed frame on one connection
+	client, server := connectedPair(t)
+	defer client.close()
+	defer server.close()
+	go client.send(Frame{Type: MsgArchive, StreamID: 1, Payload: []byte("archive")})
+	captured, readErr := ReadFrame(server.conn)
+	if readErr != nil {
+		t.Fatalf("ReadFrame() failed: %s", readErr)
+	}
+
+	// Replaying it on another connection, claiming the same key, must fail
+	otherClient, otherServer := connectedPair(t)
+	defer otherClient.close()
+	defer otherServer.close()
+	go WriteFrame(otherClient.conn, captured)
+	_, receiveErr := otherServer.receive()
+	if receiveErr == nil {
+		t.Errorf("receive() accepted signed frame replayed from another connection")
+	}
+}
+
+func TestSignedFrameRoundTripEncrypted(t *testing.T) {
+	defer useTestIdentity(t)()
+	defer useTestKey(t)()
+	client, server := connectedPair(t)
+	defer client.close()
+	defer server.close()
+
+	f, receiveErr := transmit(client, server, Frame{Type: MsgArchive, StreamID: 1, Payload: []byte("archive")})
+	if receiveErr != nil {
+		t.Fatalf("receive() of signed, encrypted frame failed: %s", receiveErr)
+	}
+	if f.Flags&FlagSigned == 0 || f.Flags&FlagEncrypted == 0 || string(f.Payload) != "archive" {
+		t.Errorf("receive() = flags %d, %q, want signed and encrypted \"archive\"", f.Flags, f.Payload)
+	}
+}
@@ -0,0 +1,122 @@
+package net
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/maride/afl-transmit/logistic"
+	"log"
+	"sync"
+)
+
+// inventory tracks which queue entries a peer acknowledged, by their name and content hash. As the same testcase may
+// show up under different names in different fuzzers, entries whose content the peer already has are skipped as well.
+// Acknowledgements are only valid for a single instance of the peer - if it restarts, it might have lost its files,
+// e.g. because its output directory lives on a ramdisk. In that case, we fall back to a full resync.
+type inventory struct {
+	lock     sync.Mutex
+	instance string
+	acked    map[string]string
+	hashes   map[string]bool
+}
+
+// newInventory creates an empty inventory
+func newInventory() *inventory {
+	return &inventory{
+		acked:  make(map[string]string),
+		hashes: make(map[string]bool),
+	}
+}
+
+// missing returns the entries the given instance of the peer did not yet acknowledge
+func (i *inventory) missing(address string, instance string, entries []logistic.Entry) []logistic.Entry {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	// Check if the peer restarted in the meantime
+	if instance != i.instance {
+		if i.instance != "" {
+			log.Printf("Peer %s restarted, falling back to full resync", address)
+		}
+		i.instance = instance
+		i.acked = make(map[string]string)
+		i.hashes = make(map[string]bool)
+	}
+
+	// Filter out the entries the peer already has, and entries with the same content as another entry
+	var missing []logistic.Entry
+	packed := make(map[string]bool)
+	for _, e := range entries {
+		if e.Hash == "" {
+			// Always send entries without hash
+			missing = append(missing, e)
+			continue
+		}
+
+		if i.acked[e.Name] == e.Hash || i.hashes[e.Hash] || packed[e.Hash] {
+			// Peer already has this content
+			continue
+		}
+
+		missing = append(missing, e)
+		packed[e.Hash] = true
+	}
+
+	return missing
+}
+
+// acknowledge records that the given instance of the peer now has the given entries
+func (i *inventory) acknowledge(instance string, entries []logistic.Entry) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	// Check if the acknowledgement is from an outdated instance
+	if instance != i.instance {
+		return
+	}
+
+	for _, e := range entries {
+		if e.Hash != "" {
+			i.acked[e.Name] = e.Hash
+			i.hashes[e.Hash] = true
+		}
+	}
+}
+
+// have records that the given instance of the peer has the testcases with the given hashes
+func (i *inventory) have(instance string, hashes []string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	// Check if the information is from an outdated instance
+	if instance != i.instance {
+		return
+	}
+
+	for _, h := range hashes {
+		i.hashes[h] = true
+	}
+}
+
+// encodeHashes converts the given hex-encoded hashes into their concatenated raw form, as used in MsgInventory
+func encodeHashes(hashes []string) []byte {
+	raw := make([]byte, 0, len(hashes)*sha256.Size)
+	for _, h := range hashes {
+		rawHash, decodeErr := hex.DecodeString(h)
+		if decodeErr != nil || len(rawHash) != sha256.Size {
+			// Not a valid SHA-256, skip it
+			continue
+		}
+		raw = append(raw, rawHash...)
+	}
+	return raw
+}
+
+// decodeHashes converts concatenated raw hashes, as used in MsgInventory, into hex-encoded hashes
+func decodeHashes(raw []byte) []string {
+	var hashes []string
+	for len(raw) >= sha256.Size {
+		hashes = append(hashes, hex.EncodeToString(raw[:sha256.Size]))
+		raw = raw[sha256.Size:]
+	}
+	return hashes
+}
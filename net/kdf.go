@@ -0,0 +1,160 @@
+package net
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/bits"
+)
+
+// Parameters for deriving keys from passphrases with scrypt, see RFC 7914. Deriving a key takes about 32 MiB of memory
+// and a fraction of a second, which is only done once on startup.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// DeriveKey derives a 32 byte key from the given passphrase, using the mesh ID as salt. All nodes of a mesh derive the
+// same key from the same passphrase.
+func DeriveKey(passphrase []byte, meshID string) []byte {
+	return scrypt(passphrase, []byte(meshID), scryptN, scryptR, scryptP, 32)
+}
+
+// scrypt implements the scrypt key derivation function as specified in RFC 7914
+func scrypt(password []byte, salt []byte, n int, r int, p int, keyLen int) []byte {
+	// Expand password into p blocks of 128*r bytes
+	b := pbkdf2(password, salt, 1, p*128*r)
+
+	// Mix each block, which is the expensive part
+	x := make([]uint32, 32*r)
+	v := make([]uint32, 32*r*n)
+	y := make([]uint32, 32*r)
+	for i := 0; i < p; i++ {
+		block := b[i*128*r : (i+1)*128*r]
+		for j := range x {
+			x[j] = binary.LittleEndian.Uint32(block[j*4:])
+		}
+		roMix(x, v, y, n, r)
+		for j := range x {
+			binary.LittleEndian.PutUint32(block[j*4:], x[j])
+		}
+	}
+
+	// Compress mixed blocks into the key
+	return pbkdf2(password, b, 1, keyLen)
+}
+
+// roMix implements scryptROMix of RFC 7914 on x, using v and y as scratch space
+func roMix(x []uint32, v []uint32, y []uint32, n int, r int) {
+	blockWords := 32 * r
+
+	// Fill v with successive mixes of x
+	for i := 0; i < n; i++ {
+		copy(v[i*blockWords:], x)
+		blockMix(x, y, r)
+	}
+
+	// Mix x with pseudo-randomly chosen entries of v
+	for i := 0; i < n; i++ {
+		j := int(x[(2*r-1)*16] & uint32(n-1))
+		for k := range x {
+			x[k] ^= v[j*blockWords+k]
+		}
+		blockMix(x, y, r)
+	}
+}
+
+// blockMix implements scryptBlockMix of RFC 7914 on b, using y as scratch space
+func blockMix(b []uint32, y []uint32, r int) {
+	var x [16]uint32
+	copy(x[:], b[(2*r-1)*16:])
+
+	for i := 0; i < 2*r; i++ {
+		for k := range x {
+			x[k] ^= b[i*16+k]
+		}
+		salsa208(&x)
+
+		// Even blocks go to the first half of the output, odd blocks to the second half
+		copy(y[((i%2)*r+i/2)*16:], x[:])
+	}
+
+	copy(b, y)
+}
+
+// salsa208 applies the Salsa20/8 core to the given block
+func salsa208(b *[16]uint32) {
+	x := *b
+	for i := 0; i < 8; i += 2 {
+		// Columns
+		x[4] ^= bits.RotateLeft32(x[0]+x[12], 7)
+		x[8] ^= bits.RotateLeft32(x[4]+x[0], 9)
+		x[12] ^= bits.RotateLeft32(x[8]+x[4], 13)
+		x[0] ^= bits.RotateLeft32(x[12]+x[8], 18)
+		x[9] ^= bits.RotateLeft32(x[5]+x[1], 7)
+		x[13] ^= bits.RotateLeft32(x[9]+x[5], 9)
+		x[1] ^= bits.RotateLeft32(x[13]+x[9], 13)
+		x[5] ^= bits.RotateLeft32(x[1]+x[13], 18)
+		x[14] ^= bits.RotateLeft32(x[10]+x[6], 7)
+		x[2] ^= bits.RotateLeft32(x[14]+x[10], 9)
+		x[6] ^= bits.RotateLeft32(x[2]+x[14], 13)
+		x[10] ^= bits.RotateLeft32(x[6]+x[2], 18)
+		x[3] ^= bits.RotateLeft32(x[15]+x[11], 7)
+		x[7] ^= bits.RotateLeft32(x[3]+x[15], 9)
+		x[11] ^= bits.RotateLeft32(x[7]+x[3], 13)
+		x[15] ^= bits.RotateLeft32(x[11]+x[7], 18)
+
+		// Rows
+		x[1] ^= bits.RotateLeft32(x[0]+x[3], 7)
+		x[2] ^= bits.RotateLeft32(x[1]+x[0], 9)
+		x[3] ^= bits.RotateLeft32(x[2]+x[1], 13)
+		x[0] ^= bits.RotateLeft32(x[3]+x[2], 18)
+		x[6] ^= bits.RotateLeft32(x[5]+x[4], 7)
+		x[7] ^= bits.RotateLeft32(x[6]+x[5], 9)
+		x[4] ^= bits.RotateLeft32(x[7]+x[6], 13)
+		x[5] ^= bits.RotateLeft32(x[4]+x[7], 18)
+		x[11] ^= bits.RotateLeft32(x[10]+x[9], 7)
+		x[8] ^= bits.RotateLeft32(x[11]+x[10], 9)
+		x[9] ^= bits.RotateLeft32(x[8]+x[11], 13)
+		x[10] ^= bits.RotateLeft32(x[9]+x[8], 18)
+		x[12] ^= bits.RotateLeft32(x[15]+x[14], 7)
+		x[13] ^= bits.RotateLeft32(x[12]+x[15], 9)
+		x[14] ^= bits.RotateLeft32(x[13]+x[12], 13)
+		x[15] ^= bits.RotateLeft32(x[14]+x[13], 18)
+	}
+	for i := range b {
+		b[i] += x[i]
+	}
+}
+
+// pbkdf2 implements PBKDF2 with HMAC-SHA256 as specified in RFC 8018
+func pbkdf2(password []byte, salt []byte, iterations int, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+
+	for block := uint32(1); len(key) < keyLen; block++ {
+		// U_1 = PRF(password, salt || INT(block))
+		prf.Reset()
+		prf.Write(salt)
+		var blockIndex [4]byte
+		binary.BigEndian.PutUint32(blockIndex[:], block)
+		prf.Write(blockIndex[:])
+		u := prf.Sum(nil)
+
+		// T = U_1 xor U_2 xor ... xor U_c
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for k := range t {
+				t[k] ^= u[k]
+			}
+		}
+
+		key = append(key, t...)
+	}
+
+	return key[:keyLen]
+}
@@ -9,98 +9,367 @@ import (
 	"io/ioutil"
 	"log"
 	"net"
+	"os"
 	"strings"
+	"time"
 )
 
 var (
 	port int
+	listenString string
 	restrictToPeers bool
+	crashDirectory string
 )
 
 // Registers the flags required for the listener
 func RegisterListenFlags() {
 	flag.IntVar(&port, "port", ServerPort, "Port to bind server component to")
-	flag.BoolVar(&restrictToPeers, "restrict-to-peers", false, "Only allow connections from peers")
+	flag.StringVar(&listenString, "listen", "", "Addresses to bind server component to, comma-separated, e.g. 10.0.0.1,[fd00::1]:1500. Addresses without port use --port. If not given, all addresses are bound, both IPv4 and IPv6")
+	flag.BoolVar(&restrictToPeers, "restrict-to-peers", false, "Only allow connections from peers, identified by their IPs. Peers given by hostname are resolved on startup and every --resolve-interval minutes")
+	flag.StringVar(&crashDirectory, "crash-directory", "", "Collect crashes and hangs sent by peers in this directory, in a subdirectory for each peer. If not given, crashes and hangs are refused")
 }
 
-// Sets up a listener and listens forever for packets on the given port, storing their contents in the outputDirectory
+// Sets up the listeners and listens forever for packets on the given addresses, storing their contents in the
+// outputDirectory
 func Listen(outputDirectory string) error {
-	// Create listener
-	addrStr := fmt.Sprintf(":%v", port)
-	listener, listenErr := net.Listen("tcp", addrStr)
-	if listenErr != nil {
-		return listenErr
+	// Get addresses to bind to
+	addresses, addressesErr := listenAddresses()
+	if addressesErr != nil {
+		return addressesErr
 	}
 
+	// Create listeners
+	var listeners []net.Listener
+	for _, address := range addresses {
+		listener, listenErr := net.Listen("tcp", address)
+		if listenErr != nil {
+			closeListeners(listeners)
+			return listenErr
+		}
+		listeners = append(listeners, listener)
+	}
+
+	// Set up access control
+	access, accessErr := newAccessControl()
+	if accessErr != nil {
+		closeListeners(listeners)
+		return accessErr
+	}
+
+	return serve(listeners, outputDirectory, access)
+}
+
+// Returns the addresses to bind to, as given by --listen. If no addresses are given, all addresses are bound, which
+// covers both IPv4 and IPv6 on dual-stack hosts.
+func listenAddresses() ([]string, error) {
+	// Check if explicit addresses are given
+	if listenString == "" {
+		return []string{fmt.Sprintf(":%d", port)}, nil
+	}
+
+	var addresses []string
+	for _, address := range strings.Split(listenString, ",") {
+		address, parseErr := parseAddress(address, port)
+		if parseErr != nil {
+			return nil, fmt.Errorf("invalid --listen: %s", parseErr)
+		}
+		addresses = append(addresses, address)
+	}
+
+	return addresses, nil
+}
+
+// Returns the ports we listen on
+func listenPorts() []string {
+	addresses, addressesErr := listenAddresses()
+	if addressesErr != nil {
+		return nil
+	}
+
+	var ports []string
+	for _, address := range addresses {
+		_, listenPort, _ := net.SplitHostPort(address)
+		ports = append(ports, listenPort)
+	}
+
+	return ports
+}
+
+// Closes all given listeners
+func closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+// Accepts connections on the given listeners forever, handling those permitted by the access control
+func serve(listeners []net.Listener, outputDirectory string, access *accessControl) error {
 	// Prepare output directory path
 	outputDirectory = strings.TrimRight(outputDirectory, "/")
 
+	// Index queue entries we already have, to avoid storing duplicates
+	index := logistic.NewHashIndex(outputDirectory)
+	go refreshIndex(index)
+
+	// Accept connections on all listeners but the first in separate threads
+	for _, listener := range listeners {
+		log.Printf("Listening on %s", listener.Addr())
+	}
+	for _, listener := range listeners[1:] {
+		go accept(listener, outputDirectory, index, access)
+	}
+	accept(listeners[0], outputDirectory, index, access)
+
+	return nil
+}
+
+// Keeps the given index up to date with the queue entries of the local fuzzers. Entries we receive are added to the
+// index while they are unpacked, so this is only required for entries the local fuzzers find. Refreshing may take a
+// while on a large corpus, so it is done here rather than while a connection waits for it.
+func refreshIndex(index *logistic.HashIndex) {
+	for {
+		index.Refresh()
+		time.Sleep(indexRefreshInterval)
+	}
+}
+
+// Accepts connections on the given listener forever, handling those permitted by the access control
+func accept(listener net.Listener, outputDirectory string, index *logistic.HashIndex, access *accessControl) {
+	// Use TLS if desired
+	listener = wrapListener(listener)
+
 	// Listen forever
 	for {
 		// Accept connection
 		conn, connErr := listener.Accept()
 		if connErr != nil {
-			log.Printf("Encountered error while accepting from %s: %s", conn.RemoteAddr().String(), connErr)
+			log.Printf("Encountered error while accepting connection: %s", connErr)
 			continue
 		}
 
-		// Check if we should restrict connections from peers
-		handleConnection := true
-		if restrictToPeers {
-			found := false
-			// Loop over peers
-			for _, p := range peers {
-				// Check if we found the remote address in our peers list
-				if p.Address == conn.RemoteAddr().String() {
-					found = true
-					break
-				}
-			}
-
-			// Handle connection only if its a peer
-			handleConnection = found
+		// Check if that host may connect at all
+		permitted, reason := access.permitsAddress(conn.RemoteAddr())
+		if !permitted {
+			log.Printf("Rejected connection from %s: %s", conn.RemoteAddr(), reason)
+			stats.PushStat(stats.Stat{RejectedConnections: 1})
+			conn.Close()
+			continue
 		}
 
-		if handleConnection {
-			// Handle in a separate thread
-			go handle(conn, outputDirectory)
-		}
+		// Handle in a separate thread
+		go handle(conn, outputDirectory, index)
 	}
 }
 
-// Handles a single connection, and unpacks the received data into outputDirectory
-func handle(conn net.Conn, outputDirectory string) {
+// Handles a single connection, and unpacks the received archives into outputDirectory.
+// The connection is kept open until the peer closes it or stops answering, and may carry multiple streams at once.
+func handle(conn net.Conn, outputDirectory string, index *logistic.HashIndex) {
+	c := newConnection(conn, remotePeerLabel(conn.RemoteAddr()))
+
 	// Make sure to close connection on return
-	defer conn.Close()
-
-	// Read raw content
-	cont, contErr := ioutil.ReadAll(conn) // bufio.NewReader(conn).ReadString('\x00')
-
-	// Check if we are able to decrypt
-	if CryptApplicable() {
-		// Decrypt packet
-		var decryptErr error
-		cont, decryptErr = Decrypt(cont)
-		if decryptErr != nil {
-			log.Printf("Failed to decrypt packet from %s: %s", conn.RemoteAddr().String(), decryptErr)
-			return
+	defer c.close()
+
+	// Make sure the peer presents a trusted certificate, if we use TLS
+	tlsErr := handshakeTLS(conn)
+	if tlsErr != nil {
+		log.Printf("TLS handshake with %s failed: %s", c.remote(), tlsErr)
+		return
+	}
+
+	// Exchange hello messages. If the peer speaks another protocol version or encrypts differently than we do, we
+	// still answer, so the peer can tell what's wrong as well.
+	helloErr := receiveHello(c)
+	if helloErr == nil || isMismatch(helloErr) {
+		sendErr := sendHello(c)
+		if helloErr == nil {
+			helloErr = sendErr
 		}
 	}
+	if helloErr != nil {
+		log.Printf("Handshake with %s failed: %s", c.remote(), helloErr)
+		return
+	}
+
+	// The peer pings us, so its interval tells when the connection is dead
+	c.established = true
+	c.keepalive = c.remoteKeepalive
 
-	if contErr == nil || contErr == io.EOF {
-		// We received the whole content, time to process it
-		unpackErr := logistic.UnpackInto(cont, outputDirectory)
-		if unpackErr != nil {
-			log.Printf("Encountered error processing packet from %s: %s", conn.RemoteAddr().String(), unpackErr)
+	// Streams which are not yet finished. Archives are unpacked while they arrive, other streams are collected first.
+	streams := newAssembler()
+	archives := make(map[uint32]*io.PipeWriter)
+
+	// Archives we refused, whose remaining frames are dropped
+	refused := make(map[uint32]bool)
+
+	// Make sure pending archives are aborted if the connection breaks
+	defer func() {
+		for _, pw := range archives {
+			pw.CloseWithError(fmt.Errorf("connection to %s closed before archive was complete", c.remote()))
+		}
+	}()
+
+	for {
+		// Read next frame
+		f, frameErr := c.receive()
+		if frameErr == io.EOF {
+			// Peer closed the connection
+			return
+		} else if frameErr != nil {
+			// We encountered an error on that connection, e.g. a truncated transfer or a version mismatch
+			log.Printf("Encountered error while reading from %s: %s", c.remote(), frameErr)
+			return
 		}
 
-		// Push read bytes to stats
-		stats.PushStat(stats.Stat{ReceivedBytes: uint64(len(cont))})
+		switch f.Type {
+		case MsgPing:
+			// Answer ping, sending its payload back
+			c.send(Frame{Type: MsgPong, StreamID: f.StreamID, Payload: f.Payload})
+		case MsgArchive, MsgFindings:
+			// Drop the remaining frames of archives we refused already
+			if refused[f.StreamID] {
+				if f.Flags&FlagEndOfStream != 0 {
+					delete(refused, f.StreamID)
+				}
+				break
+			}
+
+			// Make sure the archive is signed by a trusted peer
+			signerErr := checkSigner(c, f)
+			if signerErr != nil {
+				log.Printf("Refusing archive from %s: %s", c.remote(), signerErr)
+				if pw, ok := archives[f.StreamID]; ok {
+					// The unpacker acknowledges the failure
+					pw.CloseWithError(signerErr)
+					delete(archives, f.StreamID)
+				} else {
+					c.send(Frame{Type: MsgAck, Flags: FlagEndOfStream, StreamID: f.StreamID, Payload: []byte(signerErr.Error())})
+				}
 
-		return
+				// Remember the archive until it ends, but make sure the peer doesn't make us remember endlessly
+				if f.Flags&FlagEndOfStream == 0 {
+					if len(refused) >= maxOpenStreams {
+						log.Printf("Peer %s misbehaved, dropping connection: too many refused streams open at once", c.remote())
+						return
+					}
+					refused[f.StreamID] = true
+				}
+				break
+			}
+
+			// Find archive this frame belongs to
+			pw, ok := archives[f.StreamID]
+			if !ok {
+				// New archive, make sure the peer doesn't open streams endlessly
+				if len(archives) >= maxOpenStreams {
+					log.Printf("Peer %s misbehaved, dropping connection: too many streams open at once", c.remote())
+					return
+				}
+
+				// Unpack archive while it arrives - crashes and hangs are kept apart from the fuzzers
+				var pr *io.PipeReader
+				pr, pw = io.Pipe()
+				archives[f.StreamID] = pw
+				if f.Type == MsgArchive {
+					go unpack(c, f.StreamID, pr, outputDirectory, index)
+				} else {
+					go unpackFindings(c, f.StreamID, pr)
+				}
+			}
+
+			// Hand over payload to the unpacker. If it gave up on the archive already, the payload is dropped.
+			pw.Write(f.Payload)
+
+			// Check if we received the whole archive
+			if f.Flags&FlagEndOfStream != 0 {
+				pw.Close()
+				delete(archives, f.StreamID)
+			}
+		case MsgInventory:
+			// Collect stream
+			payload, complete, assembleErr := streams.add(f)
+			if assembleErr != nil {
+				log.Printf("Peer %s misbehaved, dropping connection: %s", c.remote(), assembleErr)
+				return
+			}
+
+			// Process the whole stream
+			if complete {
+				go answerInventory(c, f.StreamID, payload, index)
+			}
+		case MsgMembers:
+			// Collect stream
+			payload, complete, assembleErr := streams.add(f)
+			if assembleErr != nil {
+				log.Printf("Peer %s misbehaved, dropping connection: %s", c.remote(), assembleErr)
+				return
+			}
+
+			// Process the whole stream
+			if complete {
+				go answerMembers(c, f.StreamID, payload)
+			}
+		default:
+			log.Printf("Peer %s sent unexpected frame of type %d", c.remote(), f.Type)
+		}
+	}
+}
+
+// Unpacks an archive into outputDirectory while it is received, and acknowledges it to the peer
+func unpack(c *connection, streamID uint32, pr *io.PipeReader, outputDirectory string, index *logistic.HashIndex) {
+	ack := Frame{Type: MsgAck, Flags: FlagEndOfStream, StreamID: streamID}
+
+	unpackErr := logistic.UnpackInto(pr, outputDirectory, index, c.peer)
+	if unpackErr == nil {
+		// Consume whatever follows the end of the archive, so we only acknowledge complete streams
+		_, unpackErr = io.Copy(ioutil.Discard, pr)
+	}
+	if unpackErr != nil {
+		log.Printf("Encountered error processing packet from %s: %s", c.remote(), unpackErr)
+		ack.Payload = []byte(unpackErr.Error())
 	} else {
-		// We encountered an error on that connection
-		log.Printf("Encountered error while reading from %s: %s", conn.RemoteAddr().String(), contErr)
+		stats.PushPeerStat(c.peer, stats.PeerStat{ReceivedArchives: 1})
+	}
+
+	// Make sure further payload of this archive is dropped instead of blocking the connection
+	pr.Close()
+
+	c.send(ack)
+}
+
+// Unpacks an archive of crashes and hangs into the crash directory while it is received, and acknowledges it to the peer
+func unpackFindings(c *connection, streamID uint32, pr *io.PipeReader) {
+	// Check if we collect crashes at all
+	if crashDirectory == "" {
+		pr.Close()
+		c.send(Frame{Type: MsgAck, Flags: FlagEndOfStream, StreamID: streamID, Payload: []byte("this node doesn't collect crashes and hangs")})
 		return
 	}
+
+	// Keep the findings of each peer in a separate directory
+	targetDir := fmt.Sprintf("%s%c%s", strings.TrimRight(crashDirectory, "/"), os.PathSeparator, c.peer)
+	os.MkdirAll(targetDir, 0755)
+
+	// Unpack without deduplication - we want to see every crash
+	unpack(c, streamID, pr, targetDir, nil)
+}
+
+// Tells the peer which of the testcases it asked for we already have
+func answerInventory(c *connection, streamID uint32, request []byte, index *logistic.HashIndex) {
+	// Check which hashes we know
+	var known []string
+	for _, hash := range decodeHashes(request) {
+		if _, ok := index.Lookup(hash); ok {
+			known = append(known, hash)
+		}
+	}
+
+	// Send reply
+	s := newReplyStream(c, streamID, MsgInventoryReply)
+	_, writeErr := s.Write(encodeHashes(known))
+	if writeErr == nil {
+		writeErr = s.Close()
+	}
+	if writeErr != nil {
+		log.Printf("Failed to answer inventory request of %s: %s", c.remote(), writeErr)
+	}
 }
@@ -2,65 +2,279 @@ package net
 
 import (
 	"fmt"
+	"github.com/maride/afl-transmit/logistic"
 	"github.com/maride/afl-transmit/stats"
+	"log"
 	"net"
-	"regexp"
+	"strconv"
 	"strings"
-)
-
-var (
-	portSuffixRegex = regexp.MustCompile(":\\d{0,5}$")
+	"sync"
 )
 
 type Peer struct {
-	Address string
+	Address   string
+	publicKey string
+	ips       []net.IP
+	ipLock    sync.Mutex
+	session   *session
+	inventory *inventory
+	findings  *inventory
 }
 
-// Creates a peer from the given address
-func CreatePeer(address string) Peer {
+// Creates a peer from the given address, see parseAddress
+func CreatePeer(address string) (*Peer, error) {
+	address, parseErr := parseAddress(address, ServerPort)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+
+	// Return constructed Peer
+	return &Peer{
+		Address:   address,
+		session:   newSession(address),
+		inventory: newInventory(),
+		findings:  newInventory(),
+	}, nil
+}
+
+// parseAddress parses the given address into the host:port form understood by net.Dial, appending defaultPort if no
+// port is given. Hostnames, IPv4 and IPv6 literals are accepted, the latter with or without square brackets and zone
+// ID, e.g. [2001:db8::1]:1337, 2001:db8::1 or fe80::1%eth0. Note that a bare IPv6 literal never carries a port,
+// use square brackets for that.
+func parseAddress(address string, defaultPort int) (string, error) {
 	// Clean line
 	address = strings.TrimSpace(address)
+	if address == "" {
+		return "", fmt.Errorf("empty address")
+	}
 
-	// Check if a port is already part of the address
-	// This is the lazy way: if a IPv6 literal is given without square brackets and without a port, this will fail badly.
-	if !portSuffixRegex.MatchString(address) {
-		// Port number is not yet part of the address, so append the default port number
-		address = fmt.Sprintf("%s:%d", address, ServerPort)
+	// Split off the port, if a port is part of the address
+	host, port, splitErr := net.SplitHostPort(address)
+	if splitErr != nil {
+		// No port given - bare IPv6 literals and hostnames end up here
+		host = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+		port = strconv.Itoa(defaultPort)
 	}
 
-	// Return constructed Peer
-	return Peer{
-		Address: address,
+	// Check host
+	if host == "" {
+		return "", fmt.Errorf("no host given in address %s", address)
 	}
+	if strings.Contains(host, ":") && net.ParseIP(stripZone(host)) == nil {
+		return "", fmt.Errorf("invalid IPv6 address in %s", address)
+	}
+
+	// Check port
+	portNumber, portErr := strconv.ParseUint(port, 10, 16)
+	if portErr != nil || portNumber == 0 {
+		return "", fmt.Errorf("invalid port in address %s", address)
+	}
+
+	return net.JoinHostPort(host, port), nil
 }
 
-// Sends the given content to the peer
-func (p *Peer) SendToPeer(content []byte) error {
-	// Encrypt content if desired
-	if CryptApplicable() {
-		// Encrypt packet
-		var encryptErr error
-		content, encryptErr = Encrypt(content)
-		if encryptErr != nil {
-			return fmt.Errorf("Failed to decrypt packet from %s: %s", p.Address, encryptErr)
+// stripZone removes the zone ID from the given host, e.g. eth0 from fe80::1%eth0
+func stripZone(host string) string {
+	return strings.SplitN(host, "%", 2)[0]
+}
+
+// sameOptions checks if both peers were configured with the same options in the peer file
+func (p *Peer) sameOptions(other *Peer) bool {
+	return p.session.pin == other.session.pin && p.publicKey == other.publicKey
+}
+
+// resolve looks up all IPs of the peer, which are used to restrict connections to peers and to filter local peers.
+// If the lookup fails, the IPs found previously are kept.
+func (p *Peer) resolve() {
+	host := peerLabel(p.Address)
+
+	// Check if the peer is given by IP already
+	ips := []net.IP{net.ParseIP(stripZone(host))}
+	if ips[0] == nil {
+		// Look up hostname, collecting both A and AAAA records
+		var lookupErr error
+		ips, lookupErr = net.LookupIP(host)
+		if lookupErr != nil {
+			log.Printf("Unable to resolve peer %s: %s", p.Address, lookupErr)
+			return
 		}
 	}
 
-	// Build up a connection
-	tcpConn, dialErr := net.Dial("tcp", p.Address)
-	if dialErr != nil {
-		return fmt.Errorf("Unable to connect to peer %s: %s", p.Address, dialErr)
+	p.ipLock.Lock()
+	defer p.ipLock.Unlock()
+
+	// Tell the user if the IPs changed, e.g. because a cloud node was moved
+	if p.ips != nil && !sameIPs(p.ips, ips) {
+		log.Printf("Peer %s moved from %s to %s", p.Address, formatIPs(p.ips), formatIPs(ips))
 	}
+	p.ips = ips
+}
+
+// resolvedIPs returns the IPs of the peer, as found by the last call to resolve
+func (p *Peer) resolvedIPs() []net.IP {
+	p.ipLock.Lock()
+	defer p.ipLock.Unlock()
+
+	return append([]net.IP(nil), p.ips...)
+}
+
+// sameIPs checks if both lists contain the same IPs, regardless of their order
+func sameIPs(a []net.IP, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, ipA := range a {
+		found := false
+		for _, ipB := range b {
+			if ipA.Equal(ipB) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// formatIPs formats the given IPs as comma-separated list
+func formatIPs(ips []net.IP) string {
+	var ipStrings []string
+	for _, ip := range ips {
+		ipStrings = append(ipStrings, ip.String())
+	}
+	return strings.Join(ipStrings, ", ")
+}
+
+// peerLabel returns the host part of the given address, which identifies the peer in statistics
+func peerLabel(address string) string {
+	host, _, splitErr := net.SplitHostPort(address)
+	if splitErr != nil {
+		return address
+	}
+	return host
+}
 
-	// Send
-	written, writeErr := tcpConn.Write(content)
-	if writeErr != nil {
-		return fmt.Errorf("Unable to write to peer %s: %s", tcpConn.RemoteAddr().String(), writeErr)
+// remotePeerLabel returns the label of the configured peer the given remote address resolves to, so incoming and
+// outgoing connections of a peer given by hostname share their statistics. Unknown hosts are labeled by their IP.
+func remotePeerLabel(addr net.Addr) string {
+	host := peerLabel(addr.String())
+	ip := net.ParseIP(stripZone(host))
+	if ip == nil {
+		return host
 	}
 
-	// Push written bytes to stats
-	stats.PushStat(stats.Stat{SentBytes: uint64(written)})
+	for _, p := range allPeers() {
+		for _, peerIP := range p.resolvedIPs() {
+			if peerIP.Equal(ip) {
+				return peerLabel(p.Address)
+			}
+		}
+	}
+
+	return host
+}
+
+// Sends the given entries to the peer, skipping queue entries the peer already has.
+// Before sending, the peer is asked which of the testcases we didn't send yet it already has - e.g. from other nodes.
+// The remaining entries are packed into an archive, which is sent on a new stream on the connection to the peer.
+func (p *Peer) SendToPeer(entries []logistic.Entry) error {
+	// Get connection to peer
+	c, connErr := p.session.connection()
+	if connErr != nil {
+		return connErr
+	}
+
+	// Only send what this instance of the peer doesn't have yet
+	instance := c.remoteInstance
+	entries = p.inventory.missing(p.Address, instance, entries)
+
+	// Ask peer which of the remaining testcases it got from elsewhere
+	known, inventoryErr := p.askInventory(c, entries)
+	if inventoryErr != nil {
+		return fmt.Errorf("Unable to ask peer %s for its inventory: %s", p.Address, inventoryErr)
+	}
+	p.inventory.have(instance, known)
+	entries = p.inventory.missing(p.Address, instance, entries)
+
+	return p.sendArchive(c, MsgArchive, p.inventory, entries)
+}
+
+// Sends the given crashes and hangs to the peer, skipping those the peer already acknowledged
+func (p *Peer) SendFindingsToPeer(entries []logistic.Entry) error {
+	// Get connection to peer
+	c, connErr := p.session.connection()
+	if connErr != nil {
+		return connErr
+	}
+
+	// Only send what this instance of the peer doesn't have yet
+	instance := c.remoteInstance
+	entries = p.findings.missing(p.Address, instance, entries)
+	if len(entries) == 0 {
+		return nil
+	}
+
+	return p.sendArchive(c, MsgFindings, p.findings, entries)
+}
+
+// sendArchive packs the given entries into an archive of the given type, and sends it to the peer on a new stream.
+// Once the peer acknowledged the archive, the entries are recorded in the given inventory.
+func (p *Peer) sendArchive(c *connection, msgType MsgType, inv *inventory, entries []logistic.Entry) error {
+	// Open stream
+	s := p.session.openStream(c, msgType)
+
+	// Pack entries directly into the stream
+	packErr := logistic.PackEntries(s, entries)
+	if packErr != nil {
+		// Close the stream anyway, the peer will notice the archive is incomplete
+		s.Close()
+		return fmt.Errorf("Unable to send archive to peer %s: %s", p.Address, packErr)
+	}
+
+	// Close stream
+	closeErr := s.Close()
+	if closeErr != nil {
+		return fmt.Errorf("Unable to write to peer %s: %s", p.Address, closeErr)
+	}
+
+	// Wait until the peer processed the archive, then remember what it has now
+	_, ackErr := s.Wait()
+	if ackErr != nil {
+		return fmt.Errorf("Peer %s did not take the archive: %s", p.Address, ackErr)
+	}
+	inv.acknowledge(c.remoteInstance, entries)
+	stats.PeerSucceeded(c.peer, s.written)
+
+	return nil
+}
+
+// askInventory asks the peer which of the given entries it already has, returning their hashes
+func (p *Peer) askInventory(c *connection, entries []logistic.Entry) ([]string, error) {
+	// Collect hashes
+	var hashes []string
+	for _, e := range entries {
+		if e.Hash != "" {
+			hashes = append(hashes, e.Hash)
+		}
+	}
+
+	// Ask peer, in batches the peer is willing to collect
+	var known []string
+	for len(hashes) > 0 {
+		batch := hashes
+		if len(batch) > maxInventoryHashes {
+			batch = batch[:maxInventoryHashes]
+		}
+		hashes = hashes[len(batch):]
+
+		reply, replyErr := p.session.request(c, MsgInventory, encodeHashes(batch))
+		if replyErr != nil {
+			return nil, replyErr
+		}
+		known = append(known, decodeHashes(reply)...)
+	}
 
-	// Close connection
-	return tcpConn.Close()
+	return known, nil
 }
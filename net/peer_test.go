@@ -0,0 +1,112 @@
+package net
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+		valid   bool
+	}{
+		{"10.0.0.1", "10.0.0.1:1337", true},
+		{"10.0.0.1:1234", "10.0.0.1:1234", true},
+		{" 10.0.0.1:1234 ", "10.0.0.1:1234", true},
+		{"[2001:db8::1]:1234", "[2001:db8::1]:1234", true},
+		{"2001:db8::1", "[2001:db8::1]:1337", true},
+		{"[2001:db8::1]", "[2001:db8::1]:1337", true},
+		{"fe80::1%eth0", "[fe80::1%eth0]:1337", true},
+		{"[fe80::1%eth0]:1234", "[fe80::1%eth0]:1234", true},
+		{"example.com", "example.com:1337", true},
+		{"example.com:1234", "example.com:1234", true},
+		{"", "", false},
+		{"example.com:", "", false},
+		{":1234", "", false},
+		{"example.com:0", "", false},
+		{"example.com:65536", "", false},
+		{"example.com:http", "", false},
+		{"2001:db8::zz", "", false},
+		{"not:an:address", "", false},
+	}
+
+	for _, test := range tests {
+		got, parseErr := parseAddress(test.address, 1337)
+		if !test.valid {
+			if parseErr == nil {
+				t.Errorf("parseAddress(%q) = %q, want error", test.address, got)
+			}
+			continue
+		}
+		if parseErr != nil || got != test.want {
+			t.Errorf("parseAddress(%q) = %q, %v, want %q", test.address, got, parseErr, test.want)
+		}
+	}
+}
+
+func TestRemotePeerLabel(t *testing.T) {
+	// Configure a peer given by hostname, which resolved to 10.0.0.1
+	p, createErr := CreatePeer("fuzzer.example.com:1337")
+	if createErr != nil {
+		t.Fatalf("CreatePeer() failed: %s", createErr)
+	}
+	p.ips = []net.IP{net.ParseIP("10.0.0.1")}
+	peersLock.Lock()
+	peers = []*Peer{p}
+	peersLock.Unlock()
+	defer func() {
+		peersLock.Lock()
+		peers = nil
+		peersLock.Unlock()
+	}()
+
+	tests := []struct {
+		remote string
+		want   string
+	}{
+		{"10.0.0.1:51234", "fuzzer.example.com"},
+		{"[::ffff:10.0.0.1]:51234", "fuzzer.example.com"},
+		{"10.0.0.2:51234", "10.0.0.2"},
+		{"[2001:db8::1]:51234", "2001:db8::1"},
+	}
+
+	for _, test := range tests {
+		addr, resolveErr := net.ResolveTCPAddr("tcp", test.remote)
+		if resolveErr != nil {
+			t.Fatalf("ResolveTCPAddr(%q) failed: %s", test.remote, resolveErr)
+		}
+		if got := remotePeerLabel(addr); got != test.want {
+			t.Errorf("remotePeerLabel(%s) = %q, want %q", test.remote, got, test.want)
+		}
+	}
+}
+
+func TestDropLocalPeers(t *testing.T) {
+	oldPort, oldRemoveLocals := port, removeLocals
+	port, removeLocals = 1337, true
+	defer func() {
+		port, removeLocals = oldPort, oldRemoveLocals
+	}()
+
+	// Configure a peer which resolved to another host before, but resolves to this node now - and one which doesn't
+	moved, _ := CreatePeer("moved.example.com:1337")
+	moved.ips = []net.IP{net.ParseIP("127.0.0.1")}
+	remote, _ := CreatePeer("remote.example.com:1337")
+	remote.ips = []net.IP{net.ParseIP("192.0.2.1")}
+	peersLock.Lock()
+	peers = []*Peer{moved, remote}
+	peersLock.Unlock()
+	defer func() {
+		peersLock.Lock()
+		peers = nil
+		peersLock.Unlock()
+	}()
+
+	dropLocalPeers()
+
+	ps := currentPeers()
+	if len(ps) != 1 || ps[0] != remote {
+		t.Errorf("dropLocalPeers() kept %d peers, want only %s", len(ps), remote.Address)
+	}
+}
@@ -0,0 +1,159 @@
+package net
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Encrypted payloads are prefixed with an envelope, which is authenticated as additional data of the GCM:
+//
+//	+----------+-----------+-----------+-----------+-------+------------+
+//	|  key ID  | sender ID | timestamp | sequence  | nonce | ciphertext |
+//	| 4 B, BE  |   20 B    |  8 B, BE  |  8 B, BE  |       |            |
+//	+----------+-----------+-----------+-----------+-------+------------+
+//
+// Besides the envelope, the GCM authenticates the header of the frame carrying the payload - type, flags and stream ID
+// - so frames can't be retagged, moved to other streams or end their stream early. See authenticatedHeader.
+// The key ID tells the receiver which of its keys to decrypt with, see crypt.go.
+// The sender ID identifies the sending side of a single connection: the instance ID of the node, followed by a number
+// counting the connections of that node. Sequence numbers increase with each frame sent over the connection, so the
+// receiver only needs to remember the last sequence number of each sender to spot duplicated frames. Timestamps make
+// sure frames can't be replayed once the receiver forgot about the sender.
+const (
+	keyIDSize        = 4
+	senderIDSize     = 16 + 4
+	envelopeSize     = keyIDSize + senderIDSize + 8 + 8
+	maxMessageAge    = 5 * time.Minute
+	senderExpiration = 2 * maxMessageAge
+)
+
+var (
+	// connectionCounter counts the connections opened by this process, see newSenderID
+	connectionCounter uint32
+
+	// senders holds the replay state of each sender we received frames from
+	senders     = make(map[string]*senderState)
+	sendersLock sync.Mutex
+	lastPurge   time.Time
+)
+
+// senderState is what we remember about a sender to reject replayed frames
+type senderState struct {
+	lastSequence uint64
+	lastSeen     time.Time
+}
+
+// newSenderID returns a sender ID for a new connection of this node
+func newSenderID() []byte {
+	id := make([]byte, senderIDSize)
+	rawInstance, _ := hex.DecodeString(instanceID)
+	copy(id, rawInstance)
+	binary.BigEndian.PutUint32(id[16:], atomic.AddUint32(&connectionCounter, 1))
+	return id
+}
+
+// sealPayload encrypts the given payload with the current key, prefixed with an envelope carrying the given sender ID
+// and sequence number. The given header of the carrying frame or packet is authenticated as well.
+func sealPayload(payload []byte, header []byte, senderID []byte, sequence uint64) ([]byte, error) {
+	k := currentKeyring().current
+
+	// Build envelope
+	envelope := make([]byte, envelopeSize)
+	binary.BigEndian.PutUint32(envelope, k.id)
+	copy(envelope[keyIDSize:], senderID)
+	binary.BigEndian.PutUint64(envelope[keyIDSize+senderIDSize:], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint64(envelope[keyIDSize+senderIDSize+8:], sequence)
+
+	// Encrypt payload, authenticating the envelope and header along with it
+	enc, encryptErr := k.encrypt(payload, associatedData(envelope, header))
+	if encryptErr != nil {
+		return nil, encryptErr
+	}
+
+	return append(envelope, enc...), nil
+}
+
+// openPayload decrypts the given payload, and checks that its envelope is neither stale nor a duplicate, and that it
+// was sealed along with the given header
+func openPayload(sealed []byte, header []byte) ([]byte, error) {
+	// Sanity check on input
+	if len(sealed) < envelopeSize {
+		return nil, fmt.Errorf("encrypted payload is too short")
+	}
+	envelope := sealed[:envelopeSize]
+
+	// Find the key the payload was encrypted with
+	keyID := binary.BigEndian.Uint32(envelope)
+	k, ok := currentKeyring().keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("payload was encrypted with unknown key %08x", keyID)
+	}
+
+	// Decrypt payload first - we don't want to update our replay state for forged envelopes
+	payload, decryptErr := k.decrypt(sealed[envelopeSize:], associatedData(envelope, header))
+	if decryptErr != nil {
+		return nil, decryptErr
+	}
+
+	// Check for replays
+	sender := hex.EncodeToString(envelope[keyIDSize : keyIDSize+senderIDSize])
+	timestamp := time.Unix(0, int64(binary.BigEndian.Uint64(envelope[keyIDSize+senderIDSize:])))
+	sequence := binary.BigEndian.Uint64(envelope[keyIDSize+senderIDSize+8:])
+	replayErr := checkReplay(sender, timestamp, sequence)
+	if replayErr != nil {
+		return nil, replayErr
+	}
+
+	return payload, nil
+}
+
+// associatedData returns the data authenticated along with an encrypted payload: its envelope, followed by the header
+// of the frame or packet carrying it
+func associatedData(envelope []byte, header []byte) []byte {
+	data := make([]byte, 0, len(envelope)+len(header))
+	data = append(data, envelope...)
+	return append(data, header...)
+}
+
+// checkReplay checks if a frame with the given sender, timestamp and sequence number is fresh, and remembers it
+func checkReplay(sender string, timestamp time.Time, sequence uint64) error {
+	now := time.Now()
+
+	// Check if the frame is too old, or from the future - we tolerate some clock skew between nodes, though
+	age := now.Sub(timestamp)
+	if age > maxMessageAge || age < -maxMessageAge {
+		return fmt.Errorf("rejected stale frame of sender %s, sent at %s", sender, timestamp.Format(time.RFC3339))
+	}
+
+	sendersLock.Lock()
+	defer sendersLock.Unlock()
+
+	// Forget about senders which are gone long enough that their frames would be rejected as stale anyway
+	if now.Sub(lastPurge) > maxMessageAge {
+		for id, state := range senders {
+			if now.Sub(state.lastSeen) > senderExpiration {
+				delete(senders, id)
+			}
+		}
+		lastPurge = now
+	}
+
+	// Check if we saw this or a later frame of that sender already
+	state, ok := senders[sender]
+	if !ok {
+		state = &senderState{}
+		senders[sender] = state
+	}
+	if sequence <= state.lastSequence {
+		return fmt.Errorf("rejected duplicated frame of sender %s with sequence number %d", sender, sequence)
+	}
+
+	state.lastSequence = sequence
+	state.lastSeen = now
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package net
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+// testHeader is the header of the frame carrying the payloads in these tests
+var testHeader = authenticatedHeader(Frame{Type: MsgArchive, Flags: FlagEncrypted, StreamID: 1})
+
+// useTestKey makes the node encrypt with a fixed key, returning a function which disables encryption again
+func useTestKey(t *testing.T) func() {
+	ring, ringErr := newKeyring([][]byte{bytes.Repeat([]byte{0x42}, 32)})
+	if ringErr != nil {
+		t.Fatalf("newKeyring() failed: %s", ringErr)
+	}
+	keys.Store(ring)
+	return func() {
+		keys.Store((*keyring)(nil))
+	}
+}
+
+func TestOpenPayloadRoundTrip(t *testing.T) {
+	defer useTestKey(t)()
+
+	sealed, sealErr := sealPayload([]byte("payload"), testHeader, newSenderID(), 1)
+	if sealErr != nil {
+		t.Fatalf("sealPayload() failed: %s", sealErr)
+	}
+	payload, openErr := openPayload(sealed, testHeader)
+	if openErr != nil || string(payload) != "payload" {
+		t.Fatalf("openPayload() = %q, %v, want \"payload\"", payload, openErr)
+	}
+}
+
+func TestOpenPayloadRejectsDuplicates(t *testing.T) {
+	defer useTestKey(t)()
+	senderID := newSenderID()
+
+	// Receive frames 1 and 2
+	first, _ := sealPayload([]byte("first"), testHeader, senderID, 1)
+	second, _ := sealPayload([]byte("second"), testHeader, senderID, 2)
+	for _, sealed := range [][]byte{first, second} {
+		if _, openErr := openPayload(sealed, testHeader); openErr != nil {
+			t.Fatalf("openPayload() of fresh frame failed: %s", openErr)
+		}
+	}
+
+	// Both of them must not be accepted again
+	for i, sealed := range [][]byte{first, second} {
+		if _, openErr := openPayload(sealed, testHeader); openErr == nil {
+			t.Errorf("openPayload() accepted frame %d twice", i+1)
+		}
+	}
+}
+
+func TestOpenPayloadRejectsTamperedEnvelope(t *testing.T) {
+	defer useTestKey(t)()
+
+	// Change the sender ID, timestamp and sequence number - the GCM must notice
+	for _, offset := range []int{keyIDSize, keyIDSize + senderIDSize, keyIDSize + senderIDSize + 8} {
+		sealed, _ := sealPayload([]byte("payload"), testHeader, newSenderID(), 1)
+		sealed[offset] ^= 0xff
+		if _, openErr := openPayload(sealed, testHeader); openErr == nil {
+			t.Errorf("openPayload() accepted envelope changed at offset %d", offset)
+		}
+	}
+
+	// A payload encrypted with a key we don't know is refused as well
+	sealed, _ := sealPayload([]byte("payload"), testHeader, newSenderID(), 1)
+	sealed[0] ^= 0xff
+	if _, openErr := openPayload(sealed, testHeader); openErr == nil {
+		t.Errorf("openPayload() accepted payload of unknown key")
+	}
+}
+
+func TestOpenPayloadRejectsChangedHeader(t *testing.T) {
+	defer useTestKey(t)()
+
+	// Retag the frame, end its stream early, or move it to another stream - the GCM must notice
+	tests := []Frame{
+		{Type: MsgFindings, Flags: FlagEncrypted, StreamID: 1},
+		{Type: MsgArchive, Flags: FlagEncrypted | FlagEndOfStream, StreamID: 1},
+		{Type: MsgArchive, Flags: FlagEncrypted, StreamID: 2},
+	}
+
+	for _, f := range tests {
+		sealed, _ := sealPayload([]byte("payload"), testHeader, newSenderID(), 1)
+		if _, openErr := openPayload(sealed, authenticatedHeader(f)); openErr == nil {
+			t.Errorf("openPayload() accepted payload in frame of type %d, flags %d, stream %d", f.Type, f.Flags, f.StreamID)
+		}
+	}
+}
+
+func TestCheckReplayRejectsStaleFrames(t *testing.T) {
+	tests := []struct {
+		name   string
+		offset time.Duration
+		fresh  bool
+	}{
+		{"current", 0, true},
+		{"slightly old", -time.Minute, true},
+		{"slightly in the future", time.Minute, true},
+		{"stale", -maxMessageAge - time.Minute, false},
+		{"too far in the future", maxMessageAge + time.Minute, false},
+	}
+
+	for _, test := range tests {
+		sender := hex.EncodeToString(newSenderID())
+		replayErr := checkReplay(sender, time.Now().Add(test.offset), 1)
+		if (replayErr == nil) != test.fresh {
+			t.Errorf("%s: checkReplay() = %v, want fresh: %v", test.name, replayErr, test.fresh)
+		}
+	}
+}
+
+func TestCheckReplayPurgesExpiredSenders(t *testing.T) {
+	expired := hex.EncodeToString(newSenderID())
+	recent := hex.EncodeToString(newSenderID())
+
+	// Pretend we heard of one sender long ago, and of another one recently
+	sendersLock.Lock()
+	senders[expired] = &senderState{lastSequence: 1, lastSeen: time.Now().Add(-senderExpiration - time.Minute)}
+	senders[recent] = &senderState{lastSequence: 1, lastSeen: time.Now().Add(-time.Minute)}
+	lastPurge = time.Now().Add(-maxMessageAge - time.Minute)
+	sendersLock.Unlock()
+
+	// Any frame triggers the purge
+	replayErr := checkReplay(hex.EncodeToString(newSenderID()), time.Now(), 1)
+	if replayErr != nil {
+		t.Fatalf("checkReplay() of fresh frame failed: %s", replayErr)
+	}
+
+	sendersLock.Lock()
+	defer sendersLock.Unlock()
+	if _, ok := senders[expired]; ok {
+		t.Errorf("expired sender was not forgotten")
+	}
+	if _, ok := senders[recent]; !ok {
+		t.Errorf("recent sender was forgotten")
+	}
+}
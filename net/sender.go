@@ -2,50 +2,58 @@ package net
 
 import (
 	"flag"
+	"fmt"
+	"github.com/maride/afl-transmit/logistic"
 	"github.com/maride/afl-transmit/stats"
 	"io/ioutil"
 	"log"
 	"net"
+	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
 var (
-	peers      []Peer
+	peers      []*Peer
 	peerFile   string
 	peerString string
 	removeLocals bool
+	keepaliveInterval int
+	crashPeers       []*Peer
+	crashPeerString  string
+	resolveInterval  int
+	peersLock        sync.RWMutex
 )
 
+// Seconds between checks if the peer file changed
+const peerFileCheckInterval = 5
+
 // Registers flags required for peer parsing
 func RegisterSenderFlags() {
-	flag.StringVar(&peerFile, "peersFile", "", "File which contains the addresses for all peers, one per line")
+	flag.StringVar(&peerFile, "peersFile", "", "File which contains the addresses for all peers, one per line. Each address may be followed by options, e.g. pin=<pin of the peer's TLS certificate> or pubkey=<public key the peer signs archives with>. Reloaded when it changes, or on SIGHUP")
 	flag.StringVar(&peerString, "peers", "", "Addresses to peers, comma-separated.")
-	flag.BoolVar(&removeLocals, "remove-locals", false, "Skip addresses which are served on local interfaces. This allows you to use the same peer file for all of your hosts. Please note that not too much effort is spent on resolving conflicts. If you are e.g. giving hostnames as peers, filtering won't work as expected.")
+	flag.BoolVar(&removeLocals, "remove-locals", false, "Skip peers which resolve to an address of a local interface and use the port we listen on. This allows you to use the same peer file for all of your hosts.")
+	flag.StringVar(&crashPeerString, "crash-peers", "", "Addresses to peers which collect crashes and hangs, comma-separated. Those peers need to be started with --crash-directory")
+	flag.IntVar(&resolveInterval, "resolve-interval", 5, "Minutes between looking up the IPs of peers given by hostname again, e.g. for --restrict-to-peers. 0 disables it")
+	flag.IntVar(&keepaliveInterval, "keepalive", 30, "Seconds between pings on idle connections to peers. A connection is considered dead after three intervals without an answer. 0 disables pings, so idle connections are never considered dead")
 }
 
-// Send the given content to all peers
-func SendToPeers(content []byte) {
-	// Reset stats
-	alivePeers := uint8(0)
-
+// Send the given entries to all peers
+func SendToPeers(entries []logistic.Entry) {
 	// Peers where the sending process initially failed
-	var failedPeers []Peer
+	var failedPeers []*Peer
 
-	for i := 0; i < len(peers); i++ {
+	for _, p := range currentPeers() {
 		// Send to that peer
-		sendErr := peers[i].SendToPeer(content)
+		sendErr := p.SendToPeer(entries)
 		if sendErr != nil {
 			// Sending failed, retry in a second
-			failedPeers = append(failedPeers, peers[i])
-			continue
+			stats.PeerFailed(peerLabel(p.Address), sendErr)
+			failedPeers = append(failedPeers, p)
 		}
-		alivePeers++
 	}
 
-	// Set stats now - we might be updating it in a few minutes again
-	stats.SetAlivePeers(alivePeers)
-
 	// Sleep so our peers maybe come up again
 	if len(failedPeers) > 0 {
 		time.Sleep(10 * time.Second)
@@ -54,109 +62,466 @@ func SendToPeers(content []byte) {
 	// Retry
 	for i := 0; i < len(failedPeers); i++ {
 		// Send to that peer
-		sendErr := failedPeers[i].SendToPeer(content)
+		sendErr := failedPeers[i].SendToPeer(entries)
 		if sendErr != nil {
 			// Sending failed - inform user
+			stats.PeerFailed(peerLabel(failedPeers[i].Address), sendErr)
 			log.Printf("Transmission failed after retry: %s", sendErr)
-			continue
 		}
-		alivePeers++
 	}
+}
 
-	// Finally update it again, now including those peers where we retried it
-	stats.SetAlivePeers(alivePeers)
+// CollectsFindings checks if there are peers configured to receive crashes and hangs
+func CollectsFindings() bool {
+	peersLock.RLock()
+	defer peersLock.RUnlock()
+
+	return len(crashPeers) > 0
+}
+
+// Send the given crashes and hangs to all peers collecting them
+func SendFindingsToPeers(entries []logistic.Entry) {
+	peersLock.RLock()
+	targets := append([]*Peer(nil), crashPeers...)
+	peersLock.RUnlock()
+
+	for _, p := range targets {
+		sendErr := p.SendFindingsToPeer(entries)
+		if sendErr != nil {
+			stats.PeerFailed(peerLabel(p.Address), sendErr)
+			log.Printf("Transmission of crashes and hangs failed: %s", sendErr)
+		}
+	}
 }
 
 // Parses both peerString and peerFile, and adds all the peers to an internal array.
 func ReadPeers() {
-	// Read peer file if it is given
-	if peerFile != "" {
-		fileErr := readPeersFile(peerFile)
+	// Read peers - if the peer file is broken, we still use the peers given on the command line
+	regular, crash, fileErr := loadPeers(nil)
+	if fileErr != nil {
+		log.Printf("Failed to read peer file: %s", fileErr)
+	}
+
+	peersLock.Lock()
+	defer peersLock.Unlock()
+
+	installPeers(regular, crash)
+
+	// Update stats, include registered peers
+	stats.SetRegisteredPeers(uint64(len(peers)))
+
+	log.Printf("Configured %d unique peers.", len(peers))
+}
 
-		// Check if we encountered errors
-		if fileErr != nil {
-			log.Printf("Failed to read peer file: %s", fileErr)
+// ReloadPeers reads the peers again, adding new peers and removing peers which are gone. Peers which didn't change
+// keep their connection and what we know about them.
+func ReloadPeers() {
+	// Read peers, keeping the current ones if the peer file is broken. This may look up hostnames, so we don't hold
+	// the lock meanwhile.
+	regular, crash, fileErr := loadPeers(allPeers())
+	if fileErr != nil {
+		log.Printf("Failed to reload peer file, keeping current peers: %s", fileErr)
+		return
+	}
+
+	// Swap in the new peers
+	peersLock.Lock()
+	oldPeers := joinPeers(peers, crashPeers)
+	installPeers(regular, crash)
+	newPeers := joinPeers(peers, crashPeers)
+	peerCount := len(peers)
+	peersLock.Unlock()
+
+	// Tell the user about added and updated peers
+	changed := false
+	for _, p := range newPeers {
+		if containsPeer(oldPeers, p) {
+			continue
+		}
+		changed = true
+		if findPeer(oldPeers, p.Address) != nil {
+			log.Printf("Updated peer %s", p.Address)
+		} else {
+			log.Printf("Added peer %s", p.Address)
 		}
 	}
 
+	// Disconnect from removed and updated peers
+	for _, p := range oldPeers {
+		if containsPeer(newPeers, p) {
+			continue
+		}
+		changed = true
+		p.session.close()
+		if findPeer(newPeers, p.Address) == nil {
+			log.Printf("Removed peer %s", p.Address)
+
+			// Forget its stats, unless we still talk to the same host on another port
+			if !containsLabel(newPeers, peerLabel(p.Address)) {
+				stats.ForgetPeer(peerLabel(p.Address))
+			}
+		}
+	}
+	if !changed {
+		return
+	}
+
+	// Update stats, include registered peers
+	stats.SetRegisteredPeers(uint64(peerCount))
+
+	log.Printf("Configured %d unique peers.", peerCount)
+}
+
+// Reads the peers from peerString, peerFile and crashPeerString, returning the regular and the crash peers. Peers
+// already contained in known are reused, all other peers are created from scratch and looked up.
+func loadPeers(known []*Peer) ([]*Peer, []*Peer, error) {
+	var regular []*Peer
+
+	// Read peer file if it is given
+	var fileErr error
+	if peerFile != "" {
+		regular, fileErr = readPeersFile(peerFile)
+	}
+
 	// Read peer string if it is given
 	if peerString != "" {
-		readPeersString(peerString)
+		regular = append(regular, readPeersString(peerString)...)
 	}
 
 	// Remove doubles.
-	removeDoubledPeers()
+	regular = removeDoubledPeers(regular)
+
+	// Reuse known peers, and look up the IPs of all new peers, so we can tell if they are local, and know them when
+	// they connect to us
+	for i, p := range regular {
+		if k := findPeer(known, p.Address); k != nil && k.sameOptions(p) {
+			regular[i] = k
+		} else {
+			p.resolve()
+		}
+	}
 
 	// Remove locally bound if requested
 	if removeLocals {
-		removeLocalPeers()
+		regular = removeLocalPeers(regular)
 	}
 
-	// Update stats, include registered peers
-	stats.PushStat(stats.Stat{
-		RegisteredPeers: uint8(len(peers)),
-	})
+	// Read crash peers if given - reusing the connection if they are normal peers as well
+	var crash []*Peer
+	if crashPeerString != "" {
+		crash = readCrashPeersString(crashPeerString, regular, known)
+	}
 
-	log.Printf("Configured %d unique peers.", len(peers))
+	return regular, crash, fileErr
 }
 
-// Read a peer file at the given path, parses it and adds newly created Peers to the internal peers array
-func readPeersFile(path string) error {
+// Installs the given peers as the configured ones, keeping the peers we discovered or learned of by gossip. The
+// caller needs to hold peersLock.
+func installPeers(regular []*Peer, crash []*Peer) {
+	// Peers which are configured now are no longer subject to discovery and gossip
+	for p := range discovered {
+		if findPeer(regular, p.Address) != nil {
+			delete(discovered, p)
+		}
+	}
+	for _, mem := range members {
+		if mem.peer != nil && findPeer(regular, mem.Address) != nil {
+			mem.peer = nil
+		}
+	}
+	regular = append(regular, discoveredPeers()...)
+	regular = append(regular, memberPeers()...)
+
+	peers = removeDoubledPeers(regular)
+	crashPeers = crash
+}
+
+// WatchPeerFile reloads the peers whenever the peer file changes
+func WatchPeerFile() {
+	// Check if there is a file to watch at all
+	if peerFile == "" {
+		return
+	}
+
+	// Remember the current state of the file
+	lastInfo, _ := os.Stat(peerFile)
+
+	for {
+		time.Sleep(peerFileCheckInterval * time.Second)
+
+		// Check if the file changed
+		info, statErr := os.Stat(peerFile)
+		if statErr != nil {
+			// The file may be replaced right now, check again later
+			continue
+		}
+		if lastInfo != nil && info.ModTime().Equal(lastInfo.ModTime()) && info.Size() == lastInfo.Size() {
+			continue
+		}
+		lastInfo = info
+
+		log.Println("Peer file changed, reloading peers")
+		ReloadPeers()
+	}
+}
+
+// Returns a copy of the configured peers
+func currentPeers() []*Peer {
+	peersLock.RLock()
+	defer peersLock.RUnlock()
+
+	return append([]*Peer(nil), peers...)
+}
+
+// Returns all configured peers, including peers which only collect crashes and hangs
+func allPeers() []*Peer {
+	peersLock.RLock()
+	defer peersLock.RUnlock()
+
+	return joinPeers(peers, crashPeers)
+}
+
+// Returns a new array containing both given peers
+func joinPeers(a []*Peer, b []*Peer) []*Peer {
+	return append(append([]*Peer(nil), a...), b...)
+}
+
+// Returns the peer with the given address from the given peers, or nil if there is none
+func findPeer(ps []*Peer, address string) *Peer {
+	for _, p := range ps {
+		if p.Address == address {
+			return p
+		}
+	}
+	return nil
+}
+
+// Returns the peer from the given peers which is the same node as the given peer, or nil if there is none. Peers are
+// the same node if they have the same address, or the same port and one of their IPs in common - e.g. if one was
+// given by hostname, and the other one by IP.
+func matchPeer(ps []*Peer, peer *Peer) *Peer {
+	if p := findPeer(ps, peer.Address); p != nil {
+		return p
+	}
+
+	_, port, _ := net.SplitHostPort(peer.Address)
+	ips := peer.resolvedIPs()
+	for _, p := range ps {
+		if _, pPort, _ := net.SplitHostPort(p.Address); pPort != port {
+			continue
+		}
+		for _, ip := range p.resolvedIPs() {
+			for _, other := range ips {
+				if ip.Equal(other) {
+					return p
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Checks if the given peer is part of the given peers
+func containsPeer(ps []*Peer, peer *Peer) bool {
+	for _, p := range ps {
+		if p == peer {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a new array containing the given peers, except the given peer
+func removePeer(ps []*Peer, peer *Peer) []*Peer {
+	var remaining []*Peer
+	for _, p := range ps {
+		if p != peer {
+			remaining = append(remaining, p)
+		}
+	}
+	return remaining
+}
+
+// Checks if one of the given peers has the given label
+func containsLabel(ps []*Peer, label string) bool {
+	for _, p := range ps {
+		if peerLabel(p.Address) == label {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the IPs of all configured peers
+func peerIPs() []net.IP {
+	var ips []net.IP
+	for _, p := range allPeers() {
+		ips = append(ips, p.resolvedIPs()...)
+	}
+	return ips
+}
+
+// Read a peer file at the given path, parses it and returns the newly created Peers
+func readPeersFile(path string) ([]*Peer, error) {
 	// Read file
 	readContBytes, readErr := ioutil.ReadFile(path)
 	if readErr != nil {
-		return readErr
+		return nil, readErr
 	}
 
 	// Convert to string
 	readCont := string(readContBytes)
 
 	// Iterate over it, line by line
+	var ps []*Peer
 	for _, line := range strings.Split(readCont, "\n") {
 		// Check if line is usable
-		if len(line) == 0 {
-			// Empty line, ignore
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			// Empty line or comment, ignore
+			continue
+		}
+
+		// Create peer, including its options
+		p, parseErr := parsePeerLine(line)
+		if parseErr != nil {
+			log.Printf("Skipping peer in peer file: %s", parseErr)
 			continue
 		}
+
 		// Append newly created peer to array
-		peers = append(peers, CreatePeer(line))
+		ps = append(ps, p)
 	}
 
-	return nil
+	return ps, nil
+}
+
+// Parses a line of the peer file, which consists of the address of the peer, optionally followed by options in the
+// form key=value, separated by whitespace: pin is the pin of the peer's TLS certificate, pubkey the Ed25519 key the
+// peer signs its archives with.
+func parsePeerLine(line string) (*Peer, error) {
+	fields := strings.Fields(line)
+	p, createErr := CreatePeer(fields[0])
+	if createErr != nil {
+		return nil, createErr
+	}
+
+	// Apply options
+	for _, option := range fields[1:] {
+		keyValue := strings.SplitN(option, "=", 2)
+		if len(keyValue) != 2 {
+			return nil, fmt.Errorf("invalid option %s for peer %s", option, p.Address)
+		}
+
+		switch keyValue[0] {
+		case "pin":
+			pin, pinErr := parsePin(keyValue[1])
+			if pinErr != nil {
+				return nil, fmt.Errorf("invalid pin for peer %s: %s", p.Address, pinErr)
+			}
+			p.session.pin = pin
+		case "pubkey":
+			key, keyErr := parsePublicKey(keyValue[1])
+			if keyErr != nil {
+				return nil, fmt.Errorf("invalid public key for peer %s: %s", p.Address, keyErr)
+			}
+			p.publicKey = key
+		default:
+			return nil, fmt.Errorf("unknown option %s for peer %s", keyValue[0], p.Address)
+		}
+	}
+
+	return p, nil
 }
 
-// Read peers from the given string, parses it and adds newly created Peers to the internal peers array
-func readPeersString(raw string) {
-	for _, peer := range strings.Split(raw, ",") {
+// Read peers from the given string, parses it and returns the newly created Peers
+func readPeersString(raw string) []*Peer {
+	var ps []*Peer
+	for _, address := range strings.Split(raw, ",") {
+		p, createErr := CreatePeer(address)
+		if createErr != nil {
+			log.Printf("Skipping peer: %s", createErr)
+			continue
+		}
+
 		// Append newly created peer to array
-		peers = append(peers, CreatePeer(peer))
+		ps = append(ps, p)
+	}
+	return ps
+}
+
+// Read crash peers from the given string, and returns them. Peers already contained in regular or known are reused.
+func readCrashPeersString(raw string, regular []*Peer, known []*Peer) []*Peer {
+	var crash []*Peer
+	for _, address := range strings.Split(raw, ",") {
+		crashPeer, createErr := CreatePeer(address)
+		if createErr != nil {
+			log.Printf("Skipping crash peer: %s", createErr)
+			continue
+		}
+
+		// Check if we know that peer already
+		if p := findPeer(regular, crashPeer.Address); p != nil {
+			crashPeer = p
+		} else if k := findPeer(known, crashPeer.Address); k != nil && k.sameOptions(crashPeer) {
+			crashPeer = k
+		}
+
+		// Look up new peers
+		if crashPeer.resolvedIPs() == nil {
+			crashPeer.resolve()
+		}
+
+		crash = append(crash, crashPeer)
 	}
+	return crash
 }
 
-// Iterates over the peers array and removes doubles
-func removeDoubledPeers() {
+// Iterates over the given peers and removes doubles
+func removeDoubledPeers(ps []*Peer) []*Peer {
 	// Outer loop - go over all peers
-	for i := 0; i < len(peers); i++ {
+	for i := 0; i < len(ps); i++ {
 		// Inner loop - go over peers after the current (i) one, removing those with the same address
-		for j := i + 1; j < len(peers); j++ {
-			if peers[j].Address == peers[i].Address {
+		for j := i + 1; j < len(ps); j++ {
+			if ps[j].Address == ps[i].Address {
 				// Double found, remove j'th element
-				peers = append(peers[:j], peers[j+1:]...)
+				ps = append(ps[:j], ps[j+1:]...)
 			}
 		}
 	}
+	return ps
+}
+
+// Removes local peers, means peers which resolve to an address present on local interfaces and use the port we
+// listen on, from the given peers.
+func removeLocalPeers(ps []*Peer) []*Peer {
+	localIPs, localErr := localAddresses()
+	if localErr != nil {
+		log.Printf("Unable to remove local peers: %s", localErr)
+		return ps
+	}
+
+	// Check all peers against all addresses
+	for i := 0; i < len(ps); i++ {
+		if isLocalPeer(ps[i], localIPs) {
+			// Found match, remove that peer
+			log.Printf("Skipping local peer %s", ps[i].Address)
+			ps = append(ps[:i], ps[i+1:]...)
+			i--
+		}
+	}
+	return ps
 }
 
-// Removes local peers, means addresses which are present on local interfaces, from the peers array.
-func removeLocalPeers() {
+// Returns the addresses of all local interfaces
+func localAddresses() ([]net.IP, error) {
 	interfaces, interfacesErr := net.Interfaces()
 	if interfacesErr != nil {
-		log.Printf("Unable to remove local peers because interface lookup failed: %s", interfacesErr)
-		return
+		return nil, fmt.Errorf("interface lookup failed: %s", interfacesErr)
 	}
 
 	// Iterate over all interfaces, and collect all addresses
-	var blacklistPeers []Peer
+	var localIPs []net.IP
 	for _, i := range interfaces {
 		// Get all addresses of this interface
 		iAddrs, addrsErr := i.Addrs()
@@ -167,20 +532,100 @@ func removeLocalPeers() {
 
 		// Append all addresses
 		for _, a := range iAddrs {
-			blPeer := CreatePeer(a.(*net.IPNet).IP.String())
-			blacklistPeers = append(blacklistPeers, blPeer)
+			if ipNet, ok := a.(*net.IPNet); ok {
+				localIPs = append(localIPs, ipNet.IP)
+			}
 		}
 	}
 
-	// Check all peers against all addresses
-	for i := 0; i < len(peers); i++ {
-		for _, p := range blacklistPeers {
-			if peers[i].Address == p.Address {
-				// Found match, remove that peer
-				peers = append(peers[:i], peers[i+1:]...)
-				i--
-				break
+	return localIPs, nil
+}
+
+// Checks if the given peer is this node, means if it resolves to one of the given local IPs and uses our port
+func isLocalPeer(p *Peer, localIPs []net.IP) bool {
+	// Another node may run on the same host, but not on the same port
+	_, peerPort, splitErr := net.SplitHostPort(p.Address)
+	if splitErr != nil {
+		return false
+	}
+	samePort := false
+	for _, listenPort := range listenPorts() {
+		if peerPort == listenPort {
+			samePort = true
+			break
+		}
+	}
+	if !samePort {
+		return false
+	}
+
+	for _, peerIP := range p.resolvedIPs() {
+		for _, localIP := range localIPs {
+			if peerIP.Equal(localIP) {
+				return true
 			}
 		}
 	}
+
+	return false
+}
+
+// WatchPeerAddresses re-resolves the addresses of all peers every --resolve-interval minutes, so peers with changing IPs are still
+// recognized when they connect to us
+func WatchPeerAddresses() {
+	// Check if re-resolving is desired at all
+	if resolveInterval <= 0 {
+		return
+	}
+
+	for {
+		time.Sleep(time.Duration(resolveInterval) * time.Minute)
+
+		for _, p := range allPeers() {
+			p.resolve()
+		}
+
+		// A peer may resolve to this node now
+		if removeLocals {
+			dropLocalPeers()
+		}
+	}
+}
+
+// Removes peers which resolve to this node from the peers array, e.g. after their addresses changed
+func dropLocalPeers() {
+	localIPs, localErr := localAddresses()
+	if localErr != nil {
+		log.Printf("Unable to remove local peers: %s", localErr)
+		return
+	}
+
+	// Remove local peers, but disconnect from them only after releasing the lock
+	var local []*Peer
+	peersLock.Lock()
+	for _, p := range peers {
+		if isLocalPeer(p, localIPs) {
+			local = append(local, p)
+		}
+	}
+	for _, p := range local {
+		peers = removePeer(peers, p)
+		delete(discovered, p)
+		for _, mem := range members {
+			if mem.peer == p {
+				mem.peer = nil
+			}
+		}
+	}
+	peerCount := len(peers)
+	peersLock.Unlock()
+
+	for _, p := range local {
+		p.session.close()
+		stats.ForgetPeer(peerLabel(p.Address))
+		log.Printf("Peer %s resolves to this node now, removed it", p.Address)
+	}
+	if len(local) > 0 {
+		stats.SetRegisteredPeers(uint64(peerCount))
+	}
 }
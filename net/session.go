@@ -0,0 +1,193 @@
+package net
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/maride/afl-transmit/stats"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// session manages the long-lived connection to a single peer. The connection is established lazily, kept alive with
+// pings, and re-established if it breaks - with an increasing backoff if the peer is unreachable.
+type session struct {
+	address      string
+	pin          string
+	lock         sync.Mutex
+	current      *connection
+	backoff      time.Duration
+	nextDial     time.Time
+	nextStreamID uint32
+}
+
+// newSession creates a session for the peer with the given address, without connecting to it yet
+func newSession(address string) *session {
+	return &session{
+		address: address,
+	}
+}
+
+// connection returns the current connection to the peer, connecting to it if required
+func (s *session) connection() (*connection, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Check if we are still connected
+	if s.current != nil && !s.current.isClosed() {
+		return s.current, nil
+	}
+
+	// Check if we should wait a bit before reconnecting
+	if time.Now().Before(s.nextDial) {
+		return nil, fmt.Errorf("peer %s is unreachable, next connection attempt in %s", s.address, time.Until(s.nextDial).Round(time.Second))
+	}
+
+	// Build up a connection
+	conn, dialErr := dial(s.address, s.pin)
+	if dialErr != nil {
+		// Wait longer before the next attempt, up to maxBackoff
+		s.backoff = 2*s.backoff + time.Second
+		if s.backoff > maxBackoff {
+			s.backoff = maxBackoff
+		}
+		s.nextDial = time.Now().Add(s.backoff)
+		return nil, fmt.Errorf("Unable to connect to peer %s: %s", s.address, dialErr)
+	}
+	s.backoff = 0
+
+	// Say hello
+	c := newConnection(conn, peerLabel(s.address))
+	helloErr := sendHello(c)
+	if helloErr == nil {
+		helloErr = receiveHello(c)
+	}
+	if helloErr != nil {
+		c.close()
+		return nil, fmt.Errorf("Handshake with peer %s failed: %s", s.address, helloErr)
+	}
+	c.established = true
+
+	// Keep connection alive
+	s.current = c
+	go s.readLoop(c)
+	go s.keepalive(c)
+
+	return c, nil
+}
+
+// close closes the current connection to the peer, if there is one
+func (s *session) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.current != nil {
+		s.current.close()
+	}
+}
+
+// openStream opens a new stream of the given type on the given connection to the peer
+func (s *session) openStream(c *connection, msgType MsgType) *stream {
+	// Expect the peer to answer the stream
+	id := atomic.AddUint32(&s.nextStreamID, 1)
+	return &stream{
+		conn:     c,
+		id:       id,
+		msgType:  msgType,
+		response: c.expectResponse(id),
+	}
+}
+
+// request sends the given payload on a new stream of the given type over the given connection, and waits for the
+// answer of the peer
+func (s *session) request(c *connection, msgType MsgType, payload []byte) ([]byte, error) {
+	// Send request
+	st := s.openStream(c, msgType)
+	_, writeErr := st.Write(payload)
+	if writeErr == nil {
+		writeErr = st.Close()
+	}
+	if writeErr != nil {
+		return nil, writeErr
+	}
+
+	// Wait for answer
+	return st.Wait()
+}
+
+// readLoop reads frames the peer sends back to us, until the connection breaks
+func (s *session) readLoop(c *connection) {
+	defer c.close()
+
+	// Answers of the peer which are not yet complete
+	responses := newAssembler()
+
+	for {
+		// Read frame
+		f, readErr := c.receive()
+		if readErr != nil {
+			if !c.isClosed() {
+				// The peer went away without us asking for it
+				stats.PeerFailed(c.peer, fmt.Errorf("lost connection: %s", readErr))
+				if readErr != io.EOF {
+					log.Printf("Lost connection to peer %s: %s", s.address, readErr)
+				}
+			}
+			return
+		}
+
+		// Handle frame
+		switch f.Type {
+		case MsgPong:
+			// Receiving the frame already proved the connection is alive, but we also want to know the round-trip time
+			if len(f.Payload) == 8 {
+				sent := time.Unix(0, int64(binary.BigEndian.Uint64(f.Payload)))
+				stats.PeerSeen(c.peer, time.Since(sent))
+			}
+		case MsgPing:
+			c.send(Frame{Type: MsgPong, StreamID: f.StreamID, Payload: f.Payload})
+		case MsgAck, MsgInventoryReply, MsgMembersReply:
+			// Collect answer, and deliver it once complete
+			payload, complete, assembleErr := responses.add(f)
+			if assembleErr != nil {
+				log.Printf("Peer %s misbehaved, dropping connection: %s", s.address, assembleErr)
+				return
+			}
+			if complete {
+				c.deliverResponse(f.StreamID, f.Type, payload)
+			}
+		default:
+			log.Printf("Peer %s sent unexpected frame of type %d", s.address, f.Type)
+		}
+	}
+}
+
+// keepalive periodically pings the peer, until the connection breaks
+func (s *session) keepalive(c *connection) {
+	// Check if pings are desired at all
+	if keepaliveInterval <= 0 {
+		return
+	}
+
+	t := time.NewTicker(time.Duration(keepaliveInterval) * time.Second)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-t.C:
+			// Send ping with the current time, which the peer sends back to us
+			now := make([]byte, 8)
+			binary.BigEndian.PutUint64(now, uint64(time.Now().UnixNano()))
+			pingErr := c.send(Frame{Type: MsgPing, Payload: now})
+			if pingErr != nil {
+				log.Printf("Failed to ping peer %s: %s", s.address, pingErr)
+				c.close()
+				return
+			}
+		}
+	}
+}
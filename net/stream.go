@@ -0,0 +1,91 @@
+package net
+
+import (
+	"fmt"
+	"time"
+)
+
+// stream is an outgoing stream of frames over a connection, implementing io.WriteCloser.
+// Written bytes are buffered and sent in chunks of at most chunkSize bytes. Closing the stream sends the remaining
+// bytes, marking the frame as end of stream.
+type stream struct {
+	conn     *connection
+	id       uint32
+	msgType  MsgType
+	buffer   []byte
+	written  uint64
+	closed   bool
+	response chan response
+}
+
+// newReplyStream creates a stream answering the stream with the given ID, which in turn isn't answered by the peer
+func newReplyStream(c *connection, id uint32, msgType MsgType) *stream {
+	return &stream{
+		conn:    c,
+		id:      id,
+		msgType: msgType,
+	}
+}
+
+// Write buffers the given bytes and sends out full chunks
+func (s *stream) Write(p []byte) (int, error) {
+	// Check if the stream was already closed
+	if s.closed {
+		return 0, fmt.Errorf("write on closed stream %d", s.id)
+	}
+
+	// Buffer bytes
+	s.buffer = append(s.buffer, p...)
+	s.written += uint64(len(p))
+
+	// Send full chunks
+	for len(s.buffer) >= chunkSize {
+		sendErr := s.conn.send(Frame{
+			Type:     s.msgType,
+			StreamID: s.id,
+			Payload:  s.buffer[:chunkSize],
+		})
+		if sendErr != nil {
+			return 0, sendErr
+		}
+		s.buffer = s.buffer[chunkSize:]
+	}
+
+	return len(p), nil
+}
+
+// Close sends the remaining bytes and ends the stream
+func (s *stream) Close() error {
+	// Check if the stream was already closed
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	return s.conn.send(Frame{
+		Type:     s.msgType,
+		Flags:    FlagEndOfStream,
+		StreamID: s.id,
+		Payload:  s.buffer,
+	})
+}
+
+// Wait waits until the peer answered the stream, and returns the payload of the answer.
+// If the peer acknowledged the stream with an error message, that error is returned.
+func (s *stream) Wait() ([]byte, error) {
+	select {
+	case r := <-s.response:
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		// An empty acknowledgement means success, otherwise the peer tells us what went wrong
+		if r.msgType == MsgAck && len(r.payload) > 0 {
+			return nil, fmt.Errorf("peer failed to process stream %d: %s", s.id, r.payload)
+		}
+
+		return r.payload, nil
+	case <-time.After(ackTimeout):
+		return nil, fmt.Errorf("peer did not answer stream %d in time", s.id)
+	}
+}
@@ -0,0 +1,242 @@
+package net
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+var (
+	tlsCert       string
+	tlsKey        string
+	tlsCA         string
+	tlsRevoked    string
+	tlsIdentity   *tls.Certificate
+	tlsPin        string
+	tlsRoots      *x509.CertPool
+	tlsRevokedSet map[string]bool
+)
+
+// RegisterTLSFlags registers the flags required for the TLS transport
+func RegisterTLSFlags() {
+	flag.StringVar(&tlsCert, "tls-cert", "", "Certificate of this node, PEM-encoded. If given along with --tls-key, all connections use TLS 1.3 and peers need to present a certificate as well")
+	flag.StringVar(&tlsKey, "tls-key", "", "Private key for --tls-cert, PEM-encoded")
+	flag.StringVar(&tlsCA, "tls-ca", "", "CA bundle, PEM-encoded. Certificates of peers are trusted if they are signed by one of these CAs, or pinned in the peers file")
+	flag.StringVar(&tlsRevoked, "tls-revoked", "", "File which contains pins of revoked certificates, one per line. Those certificates are refused even if they are signed by the CA")
+}
+
+// InitTLS loads the certificate of this node and the certificates we trust, if the TLS transport is used
+func InitTLS() error {
+	// Check if TLS is desired at all
+	if tlsCert == "" && tlsKey == "" {
+		if tlsCA != "" || tlsRevoked != "" {
+			return fmt.Errorf("--tls-ca and --tls-revoked require --tls-cert and --tls-key")
+		}
+		return nil
+	}
+
+	// Load our own certificate
+	identity, loadErr := tls.LoadX509KeyPair(tlsCert, tlsKey)
+	if loadErr != nil {
+		return fmt.Errorf("failed to load certificate and key: %s", loadErr)
+	}
+	leaf, parseErr := x509.ParseCertificate(identity.Certificate[0])
+	if parseErr != nil {
+		return fmt.Errorf("failed to parse certificate: %s", parseErr)
+	}
+
+	// Load CA bundle if given
+	if tlsCA != "" {
+		caBytes, readErr := ioutil.ReadFile(tlsCA)
+		if readErr != nil {
+			return fmt.Errorf("failed to read CA bundle: %s", readErr)
+		}
+		tlsRoots = x509.NewCertPool()
+		if !tlsRoots.AppendCertsFromPEM(caBytes) {
+			return fmt.Errorf("no certificates found in CA bundle %s", tlsCA)
+		}
+	}
+
+	// Load revoked certificates if given
+	tlsRevokedSet = make(map[string]bool)
+	if tlsRevoked != "" {
+		revokedBytes, readErr := ioutil.ReadFile(tlsRevoked)
+		if readErr != nil {
+			return fmt.Errorf("failed to read revoked certificates: %s", readErr)
+		}
+		for _, line := range strings.Split(string(revokedBytes), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			pin, pinErr := parsePin(line)
+			if pinErr != nil {
+				return fmt.Errorf("invalid pin in %s: %s", tlsRevoked, pinErr)
+			}
+			tlsRevokedSet[pin] = true
+		}
+	}
+
+	// Without a CA, we can only trust pinned certificates
+	if tlsRoots == nil && len(trustedPins()) == 0 {
+		return fmt.Errorf("neither a CA bundle nor pinned peers are given, we wouldn't trust anyone")
+	}
+
+	tlsIdentity = &identity
+	tlsPin = certificatePin(leaf)
+
+	// Tell the user how other nodes can pin us
+	log.Printf("Using TLS, the pin of this node is %s", tlsPin)
+
+	return nil
+}
+
+// TLSApplicable checks if connections between nodes use TLS
+func TLSApplicable() bool {
+	return tlsIdentity != nil
+}
+
+// dial connects to the given address, using TLS if applicable. The certificate of the peer is checked against the
+// given pin, or against the CA if the peer is not pinned.
+func dial(address string, pin string) (net.Conn, error) {
+	if !TLSApplicable() {
+		return net.DialTimeout("tcp", address, dialTimeout)
+	}
+
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{*tlsIdentity},
+		// Nodes are identified by their certificate rather than by their name, we verify the certificate ourselves
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if pin == "" {
+				return verifyCertificate(rawCerts, nil, false)
+			}
+			return verifyCertificate(rawCerts, []string{pin}, true)
+		},
+	}
+	return tls.DialWithDialer(&net.Dialer{Timeout: dialTimeout}, "tcp", address, config)
+}
+
+// wrapListener makes the given listener use TLS if applicable, requiring clients to present a trusted certificate
+func wrapListener(listener net.Listener) net.Listener {
+	if !TLSApplicable() {
+		return listener
+	}
+
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{*tlsIdentity},
+		ClientAuth:   tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			// We trust ourselves, e.g. the members command
+			return verifyCertificate(rawCerts, append(trustedPins(), tlsPin), false)
+		},
+	}
+	return tls.NewListener(listener, config)
+}
+
+// handshakeTLS runs the TLS handshake on the given connection, if it is a TLS connection
+func handshakeTLS(conn net.Conn) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	// Don't let clients keep us waiting forever
+	tlsConn.SetDeadline(time.Now().Add(dialTimeout))
+	defer tlsConn.SetDeadline(time.Time{})
+
+	return tlsConn.Handshake()
+}
+
+// verifyCertificate checks if the given certificate chain is trusted. Revoked certificates are never trusted. Pinned
+// certificates are trusted, and so are certificates signed by the CA - unless requirePin is set, in which case only
+// the given pins are accepted.
+func verifyCertificate(rawCerts [][]byte, pins []string, requirePin bool) error {
+	// Parse certificates
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("no certificate presented")
+	}
+	var certs []*x509.Certificate
+	for _, raw := range rawCerts {
+		cert, parseErr := x509.ParseCertificate(raw)
+		if parseErr != nil {
+			return fmt.Errorf("failed to parse certificate: %s", parseErr)
+		}
+		certs = append(certs, cert)
+	}
+	leaf := certs[0]
+	pin := certificatePin(leaf)
+
+	// Check if the certificate was revoked
+	if tlsRevokedSet[pin] {
+		return fmt.Errorf("certificate %s was revoked", pin)
+	}
+
+	// Check if the certificate is pinned
+	for _, p := range pins {
+		if p == pin {
+			return nil
+		}
+	}
+	if requirePin {
+		return fmt.Errorf("certificate %s does not match pin %s", pin, strings.Join(pins, ", "))
+	}
+
+	// Check if the certificate is signed by the CA
+	if tlsRoots == nil {
+		return fmt.Errorf("certificate %s is not pinned", pin)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, verifyErr := leaf.Verify(x509.VerifyOptions{
+		Roots:         tlsRoots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if verifyErr != nil {
+		return fmt.Errorf("certificate %s is not trusted: %s", pin, verifyErr)
+	}
+
+	return nil
+}
+
+// trustedPins returns the pins of all configured peers
+func trustedPins() []string {
+	var pins []string
+	for _, p := range allPeers() {
+		if p.session.pin != "" {
+			pins = append(pins, p.session.pin)
+		}
+	}
+	return pins
+}
+
+// certificatePin returns the pin of the given certificate, which is the base64'ed SHA-256 of its public key
+func certificatePin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// parsePin checks if the given string is a valid pin, and returns it in its canonical form
+func parsePin(raw string) (string, error) {
+	sum, decodeErr := base64.StdEncoding.DecodeString(raw)
+	if decodeErr != nil {
+		return "", fmt.Errorf("failed to unpack base64'ed pin: %s", decodeErr)
+	}
+	if len(sum) != sha256.Size {
+		return "", fmt.Errorf("pin %s is not a SHA-256 hash", raw)
+	}
+	return base64.StdEncoding.EncodeToString(sum), nil
+}
@@ -0,0 +1,295 @@
+package stats
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"github.com/maride/afl-transmit/logistic"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// FuzzerStats holds the interesting parts of the fuzzer_stats file of a single fuzzer
+type FuzzerStats struct {
+	Fuzzer        string    `json:"fuzzer"`
+	Host          string    `json:"host"`
+	StartTime     time.Time `json:"start_time"`
+	LastUpdate    time.Time `json:"last_update"`
+	ExecsDone     uint64    `json:"execs_done"`
+	ExecsPerSec   float64   `json:"execs_per_sec"`
+	PathsTotal    uint64    `json:"paths_total"`
+	UniqueCrashes uint64    `json:"unique_crashes"`
+	UniqueHangs   uint64    `json:"unique_hangs"`
+	LastFind      time.Time `json:"last_find"`
+	LastCrash     time.Time `json:"last_crash"`
+}
+
+// HostStats combines the stats of all fuzzers running on a single host
+type HostStats struct {
+	Host          string    `json:"host"`
+	Fuzzers       uint64    `json:"fuzzers"`
+	ExecsPerSec   float64   `json:"execs_per_sec"`
+	PathsTotal    uint64    `json:"paths_total"`
+	UniqueCrashes uint64    `json:"unique_crashes"`
+	UniqueHangs   uint64    `json:"unique_hangs"`
+	LastFind      time.Time `json:"last_find"`
+	LastUpdate    time.Time `json:"last_update"`
+	// Stale is set if the fuzzer stats of the host weren't updated for --stale-hosts minutes, e.g. because the host
+	// left the mesh
+	Stale bool `json:"stale"`
+}
+
+// localHost is the name under which local fuzzers are listed
+const localHost = "local"
+
+var (
+	hostStats     []HostStats
+	hostStatsLock sync.Mutex
+)
+
+// ParseFuzzerStats parses a fuzzer_stats file as written by AFL and AFL++.
+// Both the old key names (e.g. paths_total) and the ones used by newer AFL++ versions (e.g. corpus_count) are read.
+func ParseFuzzerStats(r io.Reader) (FuzzerStats, error) {
+	var fs FuzzerStats
+	found := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// Each line looks like "key   : value"
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+
+		// Parse the value, depending on the key
+		var parseErr error
+		switch key {
+		case "start_time":
+			fs.StartTime, parseErr = parseTimestamp(value)
+		case "last_update":
+			fs.LastUpdate, parseErr = parseTimestamp(value)
+		case "execs_done":
+			fs.ExecsDone, parseErr = strconv.ParseUint(value, 10, 64)
+		case "execs_per_sec":
+			fs.ExecsPerSec, parseErr = strconv.ParseFloat(value, 64)
+		case "paths_total", "corpus_count":
+			fs.PathsTotal, parseErr = strconv.ParseUint(value, 10, 64)
+		case "unique_crashes", "saved_crashes":
+			fs.UniqueCrashes, parseErr = strconv.ParseUint(value, 10, 64)
+		case "unique_hangs", "saved_hangs":
+			fs.UniqueHangs, parseErr = strconv.ParseUint(value, 10, 64)
+		case "last_path", "last_find":
+			fs.LastFind, parseErr = parseTimestamp(value)
+		case "last_crash":
+			fs.LastCrash, parseErr = parseTimestamp(value)
+		default:
+			// Not of interest to us
+			continue
+		}
+		if parseErr != nil {
+			return fs, fmt.Errorf("invalid value for %s: %s", key, parseErr)
+		}
+		found = true
+	}
+	if scanErr := scanner.Err(); scanErr != nil {
+		return fs, scanErr
+	}
+
+	// Check if this was a fuzzer_stats file at all
+	if !found {
+		return fs, fmt.Errorf("no fuzzer statistics found")
+	}
+
+	return fs, nil
+}
+
+// parseTimestamp parses the given seconds since the epoch. A value of 0 means the event never happened.
+func parseTimestamp(value string) (time.Time, error) {
+	seconds, parseErr := strconv.ParseInt(value, 10, 64)
+	if parseErr != nil || seconds == 0 {
+		return time.Time{}, parseErr
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+// CollectFuzzerStats reads the fuzzer_stats files of all fuzzers in the output directory, local ones as well as those
+// received from peers. Fuzzers received from peers are attributed to the peer they were received from.
+func CollectFuzzerStats(outputDirectory string) []FuzzerStats {
+	// List files (read: fuzzers) in output directory
+	filesInDir, readErr := ioutil.ReadDir(outputDirectory)
+	if readErr != nil {
+		log.Printf("Failed to list directory content of %s: %s", outputDirectory, readErr)
+		return nil
+	}
+
+	var fuzzers []FuzzerStats
+	for _, f := range filesInDir {
+		if !f.IsDir() {
+			continue
+		}
+		fuzzerPath := fmt.Sprintf("%s%c%s", outputDirectory, os.PathSeparator, f.Name())
+
+		// Read stats of the fuzzer - not every directory is a fuzzer, and not every fuzzer wrote its stats yet
+		statsFile, openErr := os.Open(fmt.Sprintf("%s%cfuzzer_stats", fuzzerPath, os.PathSeparator))
+		if openErr != nil {
+			continue
+		}
+		fs, parseErr := ParseFuzzerStats(statsFile)
+		statsFile.Close()
+		if parseErr != nil {
+			log.Printf("Failed to parse fuzzer stats of %s: %s", fuzzerPath, parseErr)
+			continue
+		}
+
+		// Find out where the fuzzer is running
+		fs.Fuzzer = f.Name()
+		fs.Host = localHost
+		if logistic.IsRemoteFuzzer(fuzzerPath) {
+			fs.Host = logistic.RemoteOrigin(fuzzerPath)
+			if fs.Host == "" {
+				fs.Host = "unknown"
+			}
+		}
+
+		fuzzers = append(fuzzers, fs)
+	}
+
+	return fuzzers
+}
+
+// AggregateHosts combines the given fuzzer stats into the stats of each host, sorted by host
+func AggregateHosts(fuzzers []FuzzerStats) []HostStats {
+	byHost := make(map[string]*HostStats)
+	for _, fs := range fuzzers {
+		// Get the stats of this host so far
+		hs, ok := byHost[fs.Host]
+		if !ok {
+			hs = &HostStats{Host: fs.Host}
+			byHost[fs.Host] = hs
+		}
+
+		// Add this fuzzer
+		hs.add(HostStats{
+			Fuzzers:       1,
+			ExecsPerSec:   fs.ExecsPerSec,
+			PathsTotal:    fs.PathsTotal,
+			UniqueCrashes: fs.UniqueCrashes,
+			UniqueHangs:   fs.UniqueHangs,
+			LastFind:      fs.LastFind,
+			LastUpdate:    fs.LastUpdate,
+		})
+	}
+
+	var hosts []HostStats
+	for _, hs := range byHost {
+		hs.Stale = isStale(hs.LastUpdate)
+		hosts = append(hosts, *hs)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].Host < hosts[j].Host
+	})
+
+	return hosts
+}
+
+// TotalHosts combines the stats of the given hosts into the stats of the whole mesh. Stale hosts are left out, as
+// their fuzzers are most likely gone.
+func TotalHosts(hosts []HostStats) HostStats {
+	total := HostStats{Host: "total"}
+	for _, hs := range hosts {
+		if hs.Stale {
+			continue
+		}
+		total.add(hs)
+	}
+	return total
+}
+
+// isStale checks if fuzzer stats last updated at the given time are too old to be trusted. Stats without a time of
+// the last update are never stale, as we can't tell.
+func isStale(lastUpdate time.Time) bool {
+	return !lastUpdate.IsZero() && time.Since(lastUpdate) > time.Duration(staleHosts)*time.Minute
+}
+
+// add adds the counters of the given stats to hs, keeping the latest timestamps
+func (hs *HostStats) add(s HostStats) {
+	hs.Fuzzers += s.Fuzzers
+	hs.ExecsPerSec += s.ExecsPerSec
+	hs.PathsTotal += s.PathsTotal
+	hs.UniqueCrashes += s.UniqueCrashes
+	hs.UniqueHangs += s.UniqueHangs
+	if s.LastFind.After(hs.LastFind) {
+		hs.LastFind = s.LastFind
+	}
+	if s.LastUpdate.After(hs.LastUpdate) {
+		hs.LastUpdate = s.LastUpdate
+	}
+}
+
+// WatchFuzzerStats periodically reads the fuzzer stats in the output directory, so they are part of the snapshots
+func WatchFuzzerStats(outputDirectory string) {
+	for {
+		hosts := AggregateHosts(CollectFuzzerStats(outputDirectory))
+
+		hostStatsLock.Lock()
+		hostStats = hosts
+		hostStatsLock.Unlock()
+
+		time.Sleep(30 * time.Second)
+	}
+}
+
+// Hosts returns a copy of the latest stats of all hosts, sorted by host
+func Hosts() []HostStats {
+	hostStatsLock.Lock()
+	defer hostStatsLock.Unlock()
+
+	return append([]HostStats(nil), hostStats...)
+}
+
+// PrintMeshStatus prints the combined fuzzer stats of all hosts in the output directory as a table
+func PrintMeshStatus(w io.Writer, outputDirectory string) {
+	hosts := AggregateHosts(CollectFuzzerStats(outputDirectory))
+	if len(hosts) == 0 {
+		fmt.Fprintf(w, "No fuzzer stats found in %s\n", outputDirectory)
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tFUZZERS\tEXECS/S\tPATHS\tCRASHES\tHANGS\tLAST FIND\tUPDATED\tSTATUS\t")
+	staleCount := 0
+	for _, hs := range hosts {
+		status := "active"
+		if hs.Stale {
+			status = "stale"
+			staleCount++
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%d\t%d\t%d\t%s\t%s\t%s\t\n", hs.Host, hs.Fuzzers, humanize.CommafWithDigits(hs.ExecsPerSec, 0), hs.PathsTotal, hs.UniqueCrashes, hs.UniqueHangs, sinceString(hs.LastFind), sinceString(hs.LastUpdate), status)
+	}
+	total := TotalHosts(hosts)
+	fmt.Fprintf(tw, "%s\t%d\t%s\t%d\t%d\t%d\t%s\t%s\t\t\n", total.Host, total.Fuzzers, humanize.CommafWithDigits(total.ExecsPerSec, 0), total.PathsTotal, total.UniqueCrashes, total.UniqueHangs, sinceString(total.LastFind), sinceString(total.LastUpdate))
+	tw.Flush()
+
+	// Tell the user why the total may not add up
+	if staleCount > 0 {
+		fmt.Fprintf(w, "%d of %d hosts didn't update their stats for %d minutes and are not included in the total\n", staleCount, len(hosts), staleHosts)
+	}
+}
+
+// sinceString formats the given time relative to now, or "never" if it is not set
+func sinceString(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return humanize.Time(t)
+}
@@ -0,0 +1,30 @@
+package stats
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTotalHostsLeavesOutStaleHosts(t *testing.T) {
+	staleHosts = 90
+	now := time.Now()
+	fuzzers := []FuzzerStats{
+		{Fuzzer: "main", Host: "local", LastUpdate: now.Add(-time.Minute), ExecsPerSec: 100, PathsTotal: 10},
+		{Fuzzer: "main", Host: "10.0.0.2", LastUpdate: now.Add(-time.Hour), ExecsPerSec: 200, PathsTotal: 20},
+		{Fuzzer: "main", Host: "10.0.0.3", LastUpdate: now.Add(-2 * time.Hour), ExecsPerSec: 400, PathsTotal: 40},
+		{Fuzzer: "main", Host: "10.0.0.4", ExecsPerSec: 800, PathsTotal: 80},
+	}
+
+	hosts := AggregateHosts(fuzzers)
+	wantStale := map[string]bool{"local": false, "10.0.0.2": false, "10.0.0.3": true, "10.0.0.4": false}
+	for _, hs := range hosts {
+		if hs.Stale != wantStale[hs.Host] {
+			t.Errorf("host %s: Stale = %v, want %v", hs.Host, hs.Stale, wantStale[hs.Host])
+		}
+	}
+
+	total := TotalHosts(hosts)
+	if total.Fuzzers != 3 || total.ExecsPerSec != 1100 || total.PathsTotal != 110 {
+		t.Errorf("TotalHosts() = %d fuzzers, %v execs/s, %d paths, want 3 fuzzers, 1100 execs/s, 110 paths", total.Fuzzers, total.ExecsPerSec, total.PathsTotal)
+	}
+}
@@ -0,0 +1,178 @@
+package stats
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metricsAddress is the address the metrics endpoint listens on. If empty, no metrics are served.
+var metricsAddress string
+
+// RegisterMetricsFlags registers all flags required by the metrics endpoint
+func RegisterMetricsFlags() {
+	flag.StringVar(&metricsAddress, "metrics-listen", "", "Address to serve metrics on in Prometheus text format, e.g. :9137. Metrics are available under /metrics, per-peer health as JSON under /peers")
+}
+
+// ServeMetrics serves the collected statistics over HTTP, in the Prometheus text format
+func ServeMetrics() {
+	// Check if we should serve metrics
+	if metricsAddress == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/peers", handlePeers)
+	serveErr := http.ListenAndServe(metricsAddress, mux)
+	if serveErr != nil {
+		log.Printf("Failed to serve metrics on %s: %s", metricsAddress, serveErr)
+	}
+}
+
+// handleMetrics writes all metrics to the client
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	snap := TakeSnapshot()
+
+	// Global metrics
+	writeMetric(w, "afl_transmit_sent_bytes_total", "counter", "Bytes sent to peers", nil, float64(snap.SentBytes))
+	writeMetric(w, "afl_transmit_received_bytes_total", "counter", "Bytes received from peers", nil, float64(snap.ReceivedBytes))
+	writeMetric(w, "afl_transmit_registered_peers", "gauge", "Number of configured peers", nil, float64(snap.RegisteredPeers))
+	writeMetric(w, "afl_transmit_crypt_mismatches_total", "counter", "Connections refused because the peer encrypts differently than we do", nil, float64(snap.CryptMismatches))
+	writeMetric(w, "afl_transmit_rejected_connections_total", "counter", "Connections rejected by access control", nil, float64(snap.RejectedConnections))
+	writeMetric(w, "afl_transmit_alive_peers", "gauge", "Number of peers whose last transmission succeeded", nil, float64(snap.AlivePeers))
+
+	// Per-peer metrics
+	peers := snap.Peers
+	writePeerMetric(w, "afl_transmit_peer_sent_bytes_total", "counter", "Bytes sent to the peer", peers, func(ps PeerStat) float64 {
+		return float64(ps.SentBytes)
+	})
+	writePeerMetric(w, "afl_transmit_peer_received_bytes_total", "counter", "Bytes received from the peer", peers, func(ps PeerStat) float64 {
+		return float64(ps.ReceivedBytes)
+	})
+	writePeerMetric(w, "afl_transmit_peer_sent_archives_total", "counter", "Archives sent to and acknowledged by the peer", peers, func(ps PeerStat) float64 {
+		return float64(ps.SentArchives)
+	})
+	writePeerMetric(w, "afl_transmit_peer_received_archives_total", "counter", "Archives received from the peer", peers, func(ps PeerStat) float64 {
+		return float64(ps.ReceivedArchives)
+	})
+	writePeerMetric(w, "afl_transmit_peer_errors_total", "counter", "Failed transmissions to the peer", peers, func(ps PeerStat) float64 {
+		return float64(ps.Errors)
+	})
+	writePeerMetric(w, "afl_transmit_peer_consecutive_failures", "gauge", "Failed transmissions to the peer since the last successful one", peers, func(ps PeerStat) float64 {
+		return float64(ps.ConsecutiveFailures)
+	})
+	writePeerMetric(w, "afl_transmit_peer_last_archive_size_bytes", "gauge", "Size of the last archive sent to the peer", peers, func(ps PeerStat) float64 {
+		return float64(ps.LastArchiveSize)
+	})
+	writePeerMetric(w, "afl_transmit_peer_last_success_timestamp_seconds", "gauge", "Time of the last successful transmission to the peer", peers, func(ps PeerStat) float64 {
+		return timestamp(ps.LastSuccess)
+	})
+	writePeerMetric(w, "afl_transmit_peer_last_failure_timestamp_seconds", "gauge", "Time of the last failed transmission to the peer", peers, func(ps PeerStat) float64 {
+		return timestamp(ps.LastFailure)
+	})
+	writePeerMetric(w, "afl_transmit_peer_last_seen_timestamp_seconds", "gauge", "Time the peer was last seen alive", peers, func(ps PeerStat) float64 {
+		return timestamp(ps.LastSeen)
+	})
+	writePeerMetric(w, "afl_transmit_peer_rtt_seconds", "gauge", "Round-trip time of the last ping to the peer", peers, func(ps PeerStat) float64 {
+		return ps.RTT.Seconds()
+	})
+
+	// Per-host fuzzer metrics, as read from the fuzzer_stats files
+	hosts := snap.Hosts
+	writeHostMetric(w, "afl_transmit_mesh_fuzzers", "Number of fuzzers running on the host", hosts, func(hs HostStats) float64 {
+		return float64(hs.Fuzzers)
+	})
+	writeHostMetric(w, "afl_transmit_mesh_execs_per_second", "Executions per second of all fuzzers on the host", hosts, func(hs HostStats) float64 {
+		return hs.ExecsPerSec
+	})
+	writeHostMetric(w, "afl_transmit_mesh_paths", "Paths in the queues of all fuzzers on the host", hosts, func(hs HostStats) float64 {
+		return float64(hs.PathsTotal)
+	})
+	writeHostMetric(w, "afl_transmit_mesh_unique_crashes", "Unique crashes found by all fuzzers on the host", hosts, func(hs HostStats) float64 {
+		return float64(hs.UniqueCrashes)
+	})
+	writeHostMetric(w, "afl_transmit_mesh_unique_hangs", "Unique hangs found by all fuzzers on the host", hosts, func(hs HostStats) float64 {
+		return float64(hs.UniqueHangs)
+	})
+	writeHostMetric(w, "afl_transmit_mesh_last_find_timestamp_seconds", "Time of the last new path found by any fuzzer on the host", hosts, func(hs HostStats) float64 {
+		return timestamp(hs.LastFind)
+	})
+	writeHostMetric(w, "afl_transmit_mesh_last_update_timestamp_seconds", "Time the fuzzer stats of the host were last updated", hosts, func(hs HostStats) float64 {
+		return timestamp(hs.LastUpdate)
+	})
+	writeHostMetric(w, "afl_transmit_mesh_stale", "Whether the fuzzer stats of the host weren't updated for --stale-hosts minutes", hosts, func(hs HostStats) float64 {
+		if hs.Stale {
+			return 1
+		}
+		return 0
+	})
+}
+
+// handlePeers writes the stats of all peers as JSON to the client, including their last error
+func handlePeers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	encodeErr := json.NewEncoder(w).Encode(Peers())
+	if encodeErr != nil {
+		log.Printf("Failed to send peer stats: %s", encodeErr)
+	}
+}
+
+// writeMetric writes a single metric with HELP and TYPE lines
+func writeMetric(w io.Writer, name string, metricType string, help string, labels map[string]string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+	writeSample(w, name, labels, value)
+}
+
+// writePeerMetric writes a metric with one sample per peer
+func writePeerMetric(w io.Writer, name string, metricType string, help string, peers []PeerStat, value func(PeerStat) float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+	for _, ps := range peers {
+		writeSample(w, name, map[string]string{"peer": ps.Peer}, value(ps))
+	}
+}
+
+// writeHostMetric writes a gauge with one sample per host
+func writeHostMetric(w io.Writer, name string, help string, hosts []HostStats, value func(HostStats) float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	for _, hs := range hosts {
+		writeSample(w, name, map[string]string{"host": hs.Host}, value(hs))
+	}
+}
+
+// timestamp converts the given time to seconds since the epoch, or 0 if it is not set
+func timestamp(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.Unix())
+}
+
+// writeSample writes a single sample line
+func writeSample(w io.Writer, name string, labels map[string]string, value float64) {
+	// Format labels, if any
+	var labelStrings []string
+	for k, v := range labels {
+		labelStrings = append(labelStrings, fmt.Sprintf("%s=\"%s\"", k, escapeLabel(v)))
+	}
+	labelString := ""
+	if len(labelStrings) > 0 {
+		labelString = fmt.Sprintf("{%s}", strings.Join(labelStrings, ","))
+	}
+
+	fmt.Fprintf(w, "%s%s %s\n", name, labelString, strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+// escapeLabel escapes a label value as required by the Prometheus text format
+func escapeLabel(v string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(v)
+}
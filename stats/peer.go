@@ -0,0 +1,108 @@
+package stats
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// PeerStat bundles the metrics and health information we collect for a single peer
+// Per-peer stats are guarded by peerStatsLock, use Peers or TakeSnapshot to read them.
+type PeerStat struct {
+	Peer                string        `json:"peer"`
+	SentBytes           uint64        `json:"sent_bytes"`
+	ReceivedBytes       uint64        `json:"received_bytes"`
+	SentArchives        uint64        `json:"sent_archives"`
+	ReceivedArchives    uint64        `json:"received_archives"`
+	Errors              uint64        `json:"errors"`
+	ConsecutiveFailures uint64        `json:"consecutive_failures"`
+	LastArchiveSize     uint64        `json:"last_archive_size"`
+	LastSuccess         time.Time     `json:"last_success"`
+	LastFailure         time.Time     `json:"last_failure"`
+	LastError           string        `json:"last_error,omitempty"`
+	LastSeen            time.Time     `json:"last_seen"`
+	RTT                 time.Duration `json:"rtt"`
+}
+
+var (
+	peerStats     = make(map[string]*PeerStat)
+	peerStatsLock sync.Mutex
+)
+
+// PushPeerStat adds the traffic and archive counters of the given stat to the stats of the given peer
+func PushPeerStat(peer string, s PeerStat) {
+	updatePeer(peer, func(ps *PeerStat) {
+		ps.SentBytes += s.SentBytes
+		ps.ReceivedBytes += s.ReceivedBytes
+		ps.SentArchives += s.SentArchives
+		ps.ReceivedArchives += s.ReceivedArchives
+	})
+}
+
+// PeerSucceeded records a successful transmission of an archive of the given size to the given peer
+func PeerSucceeded(peer string, archiveSize uint64) {
+	updatePeer(peer, func(ps *PeerStat) {
+		ps.SentArchives++
+		ps.ConsecutiveFailures = 0
+		ps.LastArchiveSize = archiveSize
+		ps.LastSuccess = time.Now()
+		ps.LastSeen = ps.LastSuccess
+	})
+}
+
+// PeerFailed records a failed transmission to the given peer
+func PeerFailed(peer string, err error) {
+	updatePeer(peer, func(ps *PeerStat) {
+		ps.Errors++
+		ps.ConsecutiveFailures++
+		ps.LastFailure = time.Now()
+		ps.LastError = err.Error()
+	})
+}
+
+// PeerSeen records that the given peer answered a ping after the given round-trip time
+func PeerSeen(peer string, rtt time.Duration) {
+	updatePeer(peer, func(ps *PeerStat) {
+		ps.LastSeen = time.Now()
+		ps.RTT = rtt
+	})
+}
+
+// ForgetPeer removes the stats of the given peer, e.g. because it was removed from the configuration
+func ForgetPeer(peer string) {
+	peerStatsLock.Lock()
+	defer peerStatsLock.Unlock()
+
+	delete(peerStats, peer)
+}
+
+// Peers returns a copy of the stats of all peers, sorted by peer
+func Peers() []PeerStat {
+	peerStatsLock.Lock()
+	defer peerStatsLock.Unlock()
+
+	var peers []PeerStat
+	for _, ps := range peerStats {
+		peers = append(peers, *ps)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Peer < peers[j].Peer
+	})
+
+	return peers
+}
+
+// updatePeer applies the given function to the stats of the given peer, creating them if required
+func updatePeer(peer string, update func(*PeerStat)) {
+	peerStatsLock.Lock()
+	defer peerStatsLock.Unlock()
+
+	// Get current stats of that peer
+	ps, ok := peerStats[peer]
+	if !ok {
+		ps = &PeerStat{Peer: peer}
+		peerStats[peer] = ps
+	}
+
+	update(ps)
+}
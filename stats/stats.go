@@ -4,40 +4,83 @@ import (
 	"flag"
 	"fmt"
 	"github.com/dustin/go-humanize"
+	"sync/atomic"
 	"time"
 )
 
 // Stat bundles the metrics we collect into a single struct
+// All fields are only accessed atomically, as stats are pushed from many goroutines at once.
 type Stat struct {
-	SentBytes uint64
-	ReceivedBytes uint64
-	RegisteredPeers uint8
-	AlivePeer uint8
+	SentBytes           uint64
+	ReceivedBytes       uint64
+	RegisteredPeers     uint64
+	CryptMismatches     uint64
+	RejectedConnections uint64
 }
 
-// statPipe is a channel used to
+// Snapshot is a consistent copy of all statistics at a point in time, which may be used without further locking
+type Snapshot struct {
+	Stat
+	AlivePeers uint64
+	Peers      []PeerStat
+	Hosts      []HostStats
+	Time       time.Time
+}
+
+// stats holds the global counters
 var stats Stat
 
 // printStats sets whether we should print stats or not
 var printStats bool
 
+// staleHosts is the number of minutes after which a host whose fuzzer stats weren't updated is considered stale
+var staleHosts int
+
 // RegisterStatsFlags registers all flags required by the stats module
 func RegisterStatsFlags() {
 	flag.BoolVar(&printStats, "print-stats", true, "Print traffic statistics every few seconds")
+	flag.IntVar(&staleHosts, "stale-hosts", 90, "Minutes after which hosts whose fuzzer stats weren't updated are considered stale, and left out of the mesh totals. Should be a few times the --rescan interval of the nodes")
 }
 
 // PushStat pushes the given stat
-// Note that SentBytes, ReceivedBytes and RegisteredPeers are added to the current number,
-// while AlivePeer is interfaced with SetAlivePeers and is left ignored by PushStat
+// Note that all counters are added to the current number.
+// The number of alive peers is derived from the per-peer stats, see PeerSucceeded and PeerFailed.
 func PushStat(s Stat) {
-	stats.SentBytes += s.SentBytes
-	stats.ReceivedBytes += s.ReceivedBytes
-	stats.RegisteredPeers += s.RegisteredPeers
+	atomic.AddUint64(&stats.SentBytes, s.SentBytes)
+	atomic.AddUint64(&stats.ReceivedBytes, s.ReceivedBytes)
+	atomic.AddUint64(&stats.RegisteredPeers, s.RegisteredPeers)
+	atomic.AddUint64(&stats.CryptMismatches, s.CryptMismatches)
+	atomic.AddUint64(&stats.RejectedConnections, s.RejectedConnections)
 }
 
-// SetAlivePeers sets the number of alive peers, means peers we could connect to
-func SetAlivePeers(n uint8) {
-	stats.AlivePeer = n
+// SetRegisteredPeers sets the number of configured peers, which may change at runtime
+func SetRegisteredPeers(n uint64) {
+	atomic.StoreUint64(&stats.RegisteredPeers, n)
+}
+
+// TakeSnapshot returns a copy of the current statistics
+func TakeSnapshot() Snapshot {
+	snap := Snapshot{
+		Stat: Stat{
+			SentBytes:           atomic.LoadUint64(&stats.SentBytes),
+			ReceivedBytes:       atomic.LoadUint64(&stats.ReceivedBytes),
+			RegisteredPeers:     atomic.LoadUint64(&stats.RegisteredPeers),
+			CryptMismatches:     atomic.LoadUint64(&stats.CryptMismatches),
+			RejectedConnections: atomic.LoadUint64(&stats.RejectedConnections),
+		},
+		Peers: Peers(),
+		Hosts: Hosts(),
+		Time:  time.Now(),
+	}
+
+	// Count peers whose last transmission succeeded
+	for _, ps := range snap.Peers {
+		if !ps.LastSuccess.IsZero() && ps.ConsecutiveFailures == 0 {
+			snap.AlivePeers++
+		}
+	}
+
+	return snap
 }
 
 // PrintStats periodically prints the collected statistics
@@ -54,9 +97,12 @@ func PrintStats() {
 		<-t.C
 
 		// Format numbers and write them out
-		bIn := humanize.Bytes(stats.ReceivedBytes)
-		bOut := humanize.Bytes(stats.SentBytes)
+		snap := TakeSnapshot()
+		bIn := humanize.Bytes(snap.ReceivedBytes)
+		bOut := humanize.Bytes(snap.SentBytes)
 
-		fmt.Printf("Traffic: %s in / %s out | Peers: %d seen / %d registered\t\r", bIn, bOut, stats.AlivePeer, stats.RegisteredPeers)
+		mesh := TotalHosts(snap.Hosts)
+
+		fmt.Printf("Traffic: %s in / %s out | Peers: %d seen / %d registered | Mesh: %s execs/s, %d paths, %d crashes\t\r", bIn, bOut, snap.AlivePeers, snap.RegisteredPeers, humanize.CommafWithDigits(mesh.ExecsPerSec, 0), mesh.PathsTotal, mesh.UniqueCrashes)
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,137 @@
+//go:build linux
+// +build linux
+
+package watchdog
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	// testcaseEvents signal a new testcase in a queue/, crashes/ or hangs/ directory
+	testcaseEvents = syscall.IN_CLOSE_WRITE
+	// directoryEvents signal a new fuzzer in the output directory, or a new directory inside a fuzzer
+	directoryEvents = syscall.IN_CREATE | syscall.IN_MOVED_TO
+)
+
+// watchChanges watches the local fuzzers for new testcases using inotify. Changes are collected for the given window,
+// then a rescan is requested through the trigger channel. New fuzzers showing up are watched as well.
+func watchChanges(outputDirectory string, window time.Duration, trigger chan<- struct{}) error {
+	// Set up inotify
+	fd, initErr := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if initErr != nil {
+		return fmt.Errorf("failed to initialize inotify: %s", initErr)
+	}
+	defer syscall.Close(fd)
+
+	// Watch the fuzzers which are already there
+	addWatches(fd, outputDirectory)
+
+	// Read events in the background
+	events := make(chan struct{}, 1)
+	readErrs := make(chan error, 1)
+	go readEvents(fd, events, readErrs)
+
+	// Debounce events: AFL often finds multiple testcases in a row, we want to transmit them at once
+	var fire <-chan time.Time
+	for {
+		select {
+		case <-events:
+			// Start debounce window, if it isn't running already
+			if fire == nil {
+				fire = time.After(window)
+			}
+		case <-fire:
+			fire = nil
+
+			// New fuzzers or directories may have shown up in the meantime
+			addWatches(fd, outputDirectory)
+
+			// Request rescan, unless one is pending already
+			select {
+			case trigger <- struct{}{}:
+			default:
+			}
+		case readErr := <-readErrs:
+			return readErr
+		}
+	}
+}
+
+// addWatches watches the output directory, the local fuzzers in it and their testcase directories.
+// Watching an already watched directory again is a no-op.
+func addWatches(fd int, outputDirectory string) {
+	// Watch for new fuzzers
+	addWatch(fd, outputDirectory, directoryEvents)
+
+	// Search for local fuzzers - there may be none yet
+	fuzzers, _ := getLocalFuzzers(outputDirectory)
+	for _, fuzzer := range fuzzers {
+		// Watch for new directories in the fuzzer, e.g. crashes/
+		addWatch(fd, fuzzer, directoryEvents)
+
+		// Watch testcase directories of the fuzzer
+		for _, dir := range []string{"queue", "crashes", "hangs"} {
+			dirPath := fmt.Sprintf("%s%c%s", fuzzer, os.PathSeparator, dir)
+			if _, statErr := os.Stat(dirPath); statErr == nil {
+				addWatch(fd, dirPath, testcaseEvents)
+			}
+		}
+	}
+}
+
+// addWatch watches the given path for the given events
+func addWatch(fd int, path string, mask uint32) {
+	_, watchErr := syscall.InotifyAddWatch(fd, path, mask)
+	if watchErr != nil {
+		log.Printf("Unable to watch %s: %s", path, watchErr)
+	}
+}
+
+// readEvents reads inotify events from fd, signalling relevant events on the events channel
+func readEvents(fd int, events chan<- struct{}, readErrs chan<- error) {
+	buf := make([]byte, 64*1024)
+	for {
+		// Read a bunch of events
+		n, readErr := syscall.Read(fd, buf)
+		if readErr == syscall.EINTR {
+			continue
+		} else if readErr != nil {
+			readErrs <- fmt.Errorf("failed to read inotify events: %s", readErr)
+			return
+		}
+
+		// Parse events
+		relevant := false
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := string(bytes.TrimRight(buf[nameStart:nameStart+int(event.Len)], "\x00"))
+			offset = nameStart + int(event.Len)
+
+			// Skip hidden files, e.g. the temporary files written by afl-transmit itself
+			if len(name) > 0 && name[0] == '.' {
+				continue
+			}
+
+			// Only new testcases and new directories are of interest - skip e.g. fuzzer_stats being rewritten
+			if event.Mask&(syscall.IN_CLOSE_WRITE|syscall.IN_ISDIR|syscall.IN_Q_OVERFLOW) != 0 {
+				relevant = true
+			}
+		}
+
+		// Signal event, unless a signal is pending already
+		if relevant {
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package watchdog
+
+import (
+	"fmt"
+	"time"
+)
+
+// watchChanges is only supported on Linux, other systems rely on periodic rescans
+func watchChanges(outputDirectory string, window time.Duration, trigger chan<- struct{}) error {
+	return fmt.Errorf("inotify is not available on this system")
+}
@@ -8,42 +8,138 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"sync"
 	"time"
 )
 
 var (
-	rescan int
+	rescan     int
+	syncAll    bool
+	useInotify bool
+	debounce   int
 )
 
 // RegisterWatchdogFlags registers required flags for the watchdog
 func RegisterWatchdogFlags() {
 	flag.IntVar(&rescan, "rescan", 30, "Minutes to wait before rescanning local fuzzer directory")
+	flag.BoolVar(&syncAll, "sync-all", false, "Transmit all local fuzzers, not only the main node. Fuzzers received from peers are never transmitted again")
+	flag.BoolVar(&useInotify, "inotify", true, "Watch local fuzzers for new testcases and transmit them right away, instead of only every --rescan minutes. Linux only")
+	flag.IntVar(&debounce, "debounce", 10, "Seconds to collect new testcases before transmitting them, if --inotify is used")
 }
 
-// WatchFuzzers watches over the specified directory, sends updates to peers and re-scans after the specified amount of seconds
+// WatchFuzzers watches over the specified directory, sends updates to peers and re-scans after the specified amount of
+// minutes. If --inotify is used, new testcases also trigger a rescan after the debounce window.
 func WatchFuzzers(outputDirectory string) {
+	// Watch for new testcases if desired
+	trigger := make(chan struct{}, 1)
+	if useInotify {
+		go func() {
+			watchErr := watchChanges(outputDirectory, time.Duration(debounce)*time.Second, trigger)
+			if watchErr != nil {
+				log.Printf("Unable to watch fuzzers for changes, falling back to periodic rescans: %s", watchErr)
+			}
+		}()
+	}
+
 	// Loop forever
 	for {
-		// Search for main fuzzer
+		// Send updates to our peers, waiting for it to finish so rescans don't overlap
+		syncFuzzers(outputDirectory)
+
+		// Sleep until the next rescan is due, or until something changed
+		select {
+		case <-trigger:
+		case <-time.After(time.Duration(rescan) * time.Minute):
+		}
+	}
+}
+
+// syncFuzzers scans the local fuzzers and sends them to our peers
+func syncFuzzers(outputDirectory string) {
+	var wg sync.WaitGroup
+
+	// Collect important parts of the fuzzers and send them to our peers
+	entries := scanFuzzers(outputDirectory)
+	if len(entries) > 0 {
+		wg.Add(1)
+		go func() {
+			net.SendToPeers(entries)
+			wg.Done()
+		}()
+	}
+
+	// Collect crashes and hangs of all local fuzzers and send them to the peers collecting them
+	if net.CollectsFindings() {
+		findings := scanFindings(outputDirectory)
+		if len(findings) > 0 {
+			wg.Add(1)
+			go func() {
+				net.SendFindingsToPeers(findings)
+				wg.Done()
+			}()
+		}
+	}
+
+	wg.Wait()
+}
+
+// scanFuzzers collects the entries of all fuzzers we need to transmit - either only the main fuzzer, or all local
+// fuzzers if --sync-all is given
+func scanFuzzers(outputDirectory string) []logistic.Entry {
+	// Search for fuzzers to transmit
+	var targetFuzzers []string
+	if syncAll {
+		var targetErr error
+		targetFuzzers, targetErr = getLocalFuzzers(outputDirectory)
+		if targetErr != nil {
+			log.Printf("Failed to detect local fuzzers: %s", targetErr)
+			return nil
+		}
+	} else {
 		targetFuzzer, targetErr := getTargetFuzzer(outputDirectory)
 		if targetErr != nil {
 			log.Printf("Failed to detect main fuzzer: %s", targetErr)
-			continue
+			return nil
 		}
+		targetFuzzers = []string{targetFuzzer}
+	}
 
-		// Pack important parts of the fuzzer into an archive
-		packedFuzzers, packerErr := logistic.PackFuzzer(targetFuzzer, outputDirectory)
-		if packerErr != nil {
-			log.Printf("Failed to pack fuzzer: %s", packerErr)
+	// Collect important parts of each fuzzer. Each fuzzer keeps its own directory in the archive.
+	var entries []logistic.Entry
+	for _, targetFuzzer := range targetFuzzers {
+		fuzzerEntries, scanErr := logistic.ScanFuzzer(targetFuzzer, outputDirectory)
+		if scanErr != nil {
+			log.Printf("Failed to scan fuzzer: %s", scanErr)
 			continue
 		}
+		entries = append(entries, fuzzerEntries...)
+	}
 
-		// and send it to our peers
-		go net.SendToPeers(packedFuzzers)
+	return entries
+}
 
-		// Sleep a bit
-		time.Sleep(time.Duration(rescan) * time.Minute)
+// scanFindings collects the crashes and hangs of all local fuzzers. Unlike the queue, those are not imported by other
+// local fuzzers, so we need to look at every fuzzer regardless of --sync-all.
+func scanFindings(outputDirectory string) []logistic.Entry {
+	// Search for local fuzzers
+	targetFuzzers, targetErr := getLocalFuzzers(outputDirectory)
+	if targetErr != nil {
+		log.Printf("Failed to detect local fuzzers: %s", targetErr)
+		return nil
 	}
+
+	// Collect crashes and hangs of each fuzzer
+	var entries []logistic.Entry
+	for _, targetFuzzer := range targetFuzzers {
+		fuzzerEntries, scanErr := logistic.ScanFindings(targetFuzzer, outputDirectory)
+		if scanErr != nil {
+			log.Printf("Failed to scan crashes and hangs of fuzzer: %s", scanErr)
+			continue
+		}
+		entries = append(entries, fuzzerEntries...)
+	}
+
+	return entries
 }
 
 // Searches in the specified output directory for the main fuzzer.
@@ -86,3 +182,39 @@ func getTargetFuzzer(outputDirectory string) (string, error) {
 	// Failed to find the main node - probably we are in --main mode by accident
 	return "", fmt.Errorf("Unable to find main node in %s", outputDirectory)
 }
+
+// Searches in the specified output directory for all fuzzers running locally.
+// A directory is considered a local fuzzer if it contains a queue/ directory and wasn't created by afl-transmit while
+// receiving fuzzers from peers - else we would transmit our peers' fuzzers back and forth across the mesh.
+func getLocalFuzzers(outputDirectory string) ([]string, error) {
+	// List files (read: fuzzers) in output directory
+	filesInDir, readErr := ioutil.ReadDir(outputDirectory)
+	if readErr != nil {
+		return nil, fmt.Errorf("Failed to list directory content of %s: %s", outputDirectory, readErr)
+	}
+
+	var fuzzers []string
+	for _, f := range filesInDir {
+		fuzzerPath := fmt.Sprintf("%s%c%s", outputDirectory, os.PathSeparator, f.Name())
+
+		// Check if the directory looks like a fuzzer
+		queueInfo, queueErr := os.Stat(fmt.Sprintf("%s%cqueue", fuzzerPath, os.PathSeparator))
+		if queueErr != nil || !queueInfo.IsDir() {
+			continue
+		}
+
+		// Check if we received that fuzzer from a peer
+		if logistic.IsRemoteFuzzer(fuzzerPath) {
+			continue
+		}
+
+		fuzzers = append(fuzzers, fuzzerPath)
+	}
+
+	// Check if we found anything at all
+	if len(fuzzers) == 0 {
+		return nil, fmt.Errorf("Unable to find local fuzzers in %s", outputDirectory)
+	}
+
+	return fuzzers, nil
+}